@@ -1,76 +1,174 @@
-package main 
+package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
     "github.com/Tyulenb/Pennywise700/cpu"
+    "github.com/Tyulenb/Pennywise700/isa"
+    "github.com/Tyulenb/Pennywise700/predict"
 )
 
 func main() {
-    args := os.Args
+    limit := flag.Int("limit", 1024, "max amount of cycles to emulate")
+    jsonPath := flag.String("json", "", "file to write performance counters in JSON")
+    mulCycles := flag.Int("mul", 4, "cycles MUL stays on Execute")
+    divCycles := flag.Int("div", 8, "cycles DIV and MOD stay on Execute")
+    diagramPath := flag.String("diagram", "", "file to write pipeline diagram, format is taken from extension: .md, .csv or .html")
+    inputPath := flag.String("input", "", "file with numbers for input port, - for standard input")
+    mem := flag.Int("mem", isa.DefaultConfig.Mem, "cells of data memory")
+    cmd := flag.Int("cmd", isa.DefaultConfig.Cmd, "cells of command memory")
+    regs := flag.Int("regs", isa.DefaultConfig.Regs, "registers")
+    forwarding := flag.String("forward", "wb", "paths results are forwarded by: none, wb (from write back), ex (from execute) or full")
+    predictor := flag.String("predict", "not-taken", "branch predictor: "+strings.Join(predict.Names, ", "))
+    resolution := flag.String("resolve", "wb", "stages jumps are resolved on: wb (all on write back) or early (JMP on decode 1, conditional jumps on execute)")
+    handler := flag.Int("handler", -1, "address of exception handler, exceptions stop the machine if it's not given")
+    flag.Usage = func() {
+        fmt.Println("FORMAT cmd.go [-limit N] 'path to your program' 'd (optionaly for debug)'\n"+
+        "go run cmd.go program.txt\ngo run cmd.go program.txt d (for debug)\n"+
+        "go run cmd.go -limit 4096 program.txt\n"+
+        "go run cmd.go -json stats.json program.txt\n"+
+        "go run cmd.go -diagram pipe.md program.txt\n"+
+        "go run cmd.go -mul 2 -div 16 program.txt\n"+
+        "go run cmd.go -input data.txt program.txt\n"+
+        "go run cmd.go -handler 100 program.txt\n"+
+        "go run cmd.go -mem 4096 -regs 32 program.txt\n"+
+        "go run cmd.go -forward full program.txt\n"+
+        "go run cmd.go -predict 2bit program.txt\n"+
+        "go run cmd.go -resolve early program.txt")
+    }
+    flag.Parse()
+    args := flag.Args()
     path := "program.txt"
     debugMode := false
-    if len(args) >= 2 {
-        path = args[1]
-        if len(args) > 2 && args[2] == "d" {
+    if len(args) >= 1 {
+        path = args[0]
+        if len(args) > 1 && args[1] == "d" {
             debugMode = true
         }
     }else {
-        fmt.Println("FORMAT cmd.go 'path to your program' 'd (optionaly for debug)'\n"+
-        "go run cmd.go program.txt\ngo run cmd.go program.txt d (for debug)")
+        flag.Usage()
         return
     }
-    p := cpu.NewPennywise700()
-    p.DebugMode = debugMode
-    p.Load(path)
+    //Debugger reads its commands from standard input, numbers can't be read from it too
+    if debugMode && *inputPath == "-" {
+        fmt.Println("Standard input is taken by debugger, give a file with -input")
+        os.Exit(1)
+    }
+    p, err := cpu.New(isa.Config{Mem: *mem, Cmd: *cmd, Regs: *regs})
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    p.MulCycles, p.DivCycles = *mulCycles, *divCycles
+    if p.Forwarding, err = cpu.ParseForwarding(*forwarding); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    if p.Resolution, err = cpu.ParseResolution(*resolution); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    if p.Predictor, err = predict.Parse(*predictor); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    p.Console = os.Stdout
+    switch *inputPath {
+    case "":
+    case "-":
+        p.SetInput(os.Stdin)
+    default:
+        input, err := os.Open(*inputPath)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        defer input.Close()
+        p.SetInput(input)
+    }
+    if err := p.LoadFile(path); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    if *handler >= 0 {
+        if err := p.SetHandler(uint16(min(*handler, 0xFFFF))); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    if *diagramPath != "" {
+        p.RecordDiagram()
+    }
+    var fault error
     if debugMode {
-        Debug(p)
+        Debug(p, *limit)
     }else {
-        Run(p)
+        fault = Run(p, *limit)
+    }
+    fmt.Printf("Forwarding: %v\nPredictor: %v\nResolution: %v\n", p.Forwarding, *predictor, p.Resolution)
+    fmt.Print(p.GetStats())
+    if *jsonPath != "" {
+        if err := writeStats(p, *jsonPath); err != nil {
+            fmt.Println(err)
+        }
+    }
+    if *diagramPath != "" {
+        if err := writeDiagram(p, *diagramPath); err != nil {
+            fmt.Println(err)
+        }
+    }
+    if fault != nil {
+        os.Exit(1)
     }
 }
 
-func Run(p *cpu.Pennywise700) {
-    for range 1024 {
-        p.EmulateCycle()
+func writeStats(p *cpu.Pennywise700, path string) error {
+    data, err := json.MarshalIndent(p.GetStats(), "", "  ")
+    if err != nil {
+        return err
     }
-    mem := p.GetMem()
-    fmt.Println("MEM[0:10]",mem[0:10])
+    return os.WriteFile(path, data, 0644)
+}
+
+func writeDiagram(p *cpu.Pennywise700, path string) error {
+    var data bytes.Buffer
+    format := strings.TrimPrefix(filepath.Ext(path), ".")
+    if err := p.GetDiagram().Write(&data, format); err != nil {
+        return err
+    }
+    return os.WriteFile(path, data.Bytes(), 0644)
 }
 
-func Debug(p *cpu.Pennywise700) {
-    fmt.Println("Enter - step for next command\nq - to exit")
-    var arg string = "s"
-    commands := map[uint32]string{
-        0x0: "NOP",
-        0x1: "LTM",
-        0x2: "MTR",
-        0x3: "RTR",
-        0x4: "SUB",
-        0x5: "JUMP_LESS",
-        0x6: "MTRK",
-        0x7: "RTMK",
-        0x8: "JMP",       
-        0x9: "SUM",     
-    }
-    for { 
-        fmt.Scanln(&arg)
-        switch(arg) {
-        default:
-            fmt.Println("PC:", p.GetPc())
-            cmd_mem := p.GetCommands()
-            fmt.Println("Commands [0:10]", cmd_mem[0:10])
-            fmt.Println("Cur command", commands[p.GetCurCommand()>>20])
-            p.EmulateCycle()
-            fmt.Println("Cycle Results:")
-            mem := p.GetMem()
-            pipe := p.GetPipeline()
-            fmt.Println("MEM[0:10]",mem[0:10])
-            fmt.Println("REGS:", p.RF)
-            fmt.Println("PIPE:", pipe)
+//Emulates one cycle, returns the fault which stopped the machine
+func step(p *cpu.Pennywise700) error {
+    p.EmulateCycle()
+    return p.Fault()
+}
 
-        case "q":
-            return
-        }
+//Runs program until HALT, fault or the limit of cycles, returns the fault
+func Run(p *cpu.Pennywise700, limit int) error {
+    cycles := 0
+    var fault error
+    for !p.Halted() && fault == nil && cycles < limit {
+        fault = step(p)
+        cycles++
+    }
+    switch {
+    case fault != nil:
+        fmt.Printf("FAULT on cycle %d: %v\n", cycles, fault)
+    case p.Halted():
+        fmt.Printf("HALT after %d cycles\n", cycles)
+    default:
+        fmt.Printf("Cycle limit of %d reached\n", limit)
     }
+    mem := p.GetMem()
+    //Memory may be smaller than 10 cells
+    shown := mem[:min(10, len(mem))]
+    fmt.Printf("MEM[0:%d] %v\n", len(shown), shown)
+    return fault
 }
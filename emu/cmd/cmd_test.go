@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Tyulenb/Pennywise700/cpu"
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+// Memory of 8 cells is allowed, Run shows all of it
+func TestRunSmallMemory(t *testing.T) {
+    p, err := cpu.New(isa.Config{Mem: 8, Cmd: 8, Regs: 4})
+    if err != nil {
+        t.Fatal(err)
+    }
+    set := p.ISA()
+    err = p.LoadProgram([]uint32{set.ByMnemonic("LTM").Encode([]uint16{5, 0}), set.ByMnemonic("HALT").Encode(nil)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fault := Run(p, 100); fault != nil {
+        t.Fatal(fault)
+    }
+    if !p.Halted() {
+        t.Error("program isn't halted")
+    }
+}
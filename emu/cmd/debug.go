@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Tyulenb/Pennywise700/cpu"
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+const debugHelp = `Commands:
+  Enter, step [N]    emulate N cycles, 1 by default
+  stepi              emulate until the next command retires
+  continue           emulate until breakpoint, watchpoint, HALT or fault
+  break <pc>         stop when command at pc is fetched, (speculative) if an older jump
+                     isn't resolved yet and the command may be dropped
+  watch r<n>         stop when register changes
+  watch mem[<adr>]   stop when memory cell changes
+  print r<n> | mem[<adr>] | pc | sp | flags
+  x/N mem|cmd <adr>  show N cells of memory or commands from adr
+  disas [adr [N]]    disassemble N commands from adr, pc by default
+  pipe               show commands and ALU latches of every stage
+  stats              show performance counters
+  trace              switch printing of every stage on and off
+  q                  exit`
+
+// Register, memory cell, pc or flags
+type loc struct {
+    name  string
+    mem   bool
+    pc    bool
+    flags bool
+    //Stack pointer is the last register, it depends on machine
+    sp    bool
+    adr   uint16
+}
+
+func parseLoc(s string) (loc, error) {
+    switch {
+    case s == "pc":
+        return loc{name: s, pc: true}, nil
+    case s == "sp":
+        return loc{name: s, sp: true}, nil
+    case s == "flags":
+        return loc{name: s, flags: true}, nil
+    case strings.HasPrefix(s, "r"):
+        r, err := strconv.ParseUint(s[1:], 10, 16)
+        return loc{name: s, adr: uint16(r)}, err
+    case strings.HasPrefix(s, "mem[") && strings.HasSuffix(s, "]"):
+        adr, err := strconv.ParseUint(s[4:len(s)-1], 10, 16)
+        return loc{name: s, mem: true, adr: uint16(adr)}, err
+    }
+    return loc{}, fmt.Errorf("Expected r<n>, mem[<adr>], pc, sp or flags, but got %v", s)
+}
+
+type watch struct {
+    loc loc
+    val uint16
+}
+
+type debugger struct {
+    p       *cpu.Pennywise700
+    limit   int
+    breaks  map[uint16]bool
+    watches []watch
+    //Machine halted or faulted, nothing can be emulated anymore
+    done    bool
+}
+
+func (d *debugger) value(l loc) (uint16, error) {
+    switch {
+    case l.pc:
+        return d.p.GetPc(), nil
+    case l.flags:
+        return d.p.GetFlags(), nil
+    case l.mem:
+        return d.p.GetMemCell(l.adr)
+    case l.sp:
+        return d.p.GetReg(d.p.ISA().SP)
+    }
+    return d.p.GetReg(l.adr)
+}
+
+//Emulates one cycle, returns the reason to stop if there is one
+func (d *debugger) cycle() (string, bool) {
+    if d.done {
+        return "Machine is stopped", true
+    }
+    fetched := d.p.GetStages()[isa.Fetch]
+    if fault := step(d.p); fault != nil {
+        d.done = true
+        return fmt.Sprintf("FAULT: %v", fault), true
+    }
+    if d.p.Halted() {
+        d.done = true
+        return "HALT", true
+    }
+    for i, w := range d.watches {
+        val, _ := d.value(w.loc)
+        if val != w.val {
+            d.watches[i].val = val
+            return fmt.Sprintf("Watchpoint %v: %d -> %d", w.loc.name, w.val, val), true
+        }
+    }
+    //Command refetched because of stall doesn't hit the breakpoint again
+    //Fetch may be on the wrong path of a jump, it's told then
+    fetch := d.p.GetStages()[isa.Fetch]
+    if fetch.Valid && d.breaks[fetch.Adr] && !(fetched.Valid && fetched.Adr == fetch.Adr) {
+        reason := fmt.Sprintf("Breakpoint at %d: %v", fetch.Adr, d.p.ISA().Disassemble(fetch.Cmd))
+        if d.p.Speculative(isa.Fetch) {
+            reason += " (speculative)"
+        }
+        return reason, true
+    }
+    return "", false
+}
+
+//Emulates n cycles or less, if cycle says to stop or until is true
+//Negative n runs until the cycle limit
+func (d *debugger) run(n int, until func() bool) {
+    limited := n < 0
+    if limited {
+        n = d.limit
+    }
+    for i := 0; i < n; i++ {
+        if reason, stop := d.cycle(); stop {
+            fmt.Println(reason)
+            break
+        }
+        if until != nil && until() {
+            break
+        }
+        if limited && i == n-1 {
+            fmt.Printf("Cycle limit of %d reached\n", d.limit)
+        }
+    }
+    fmt.Printf("Cycle %d, PC: %d\n", d.p.GetStats().Cycles, d.p.GetPc())
+}
+
+func (d *debugger) examine(count int, space string, start uint16) error {
+    for i := range count {
+        adr := start + uint16(i)
+        if space == "cmd" {
+            cmd, err := d.p.GetCommand(adr)
+            if err != nil {
+                return err
+            }
+            fmt.Printf("%5d: %0*b\n", adr, d.p.ISA().Width, cmd)
+            continue
+        }
+        val, err := d.p.GetMemCell(adr)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%5d: %d\n", adr, val)
+    }
+    return nil
+}
+
+func (d *debugger) disas(start uint16, count int) {
+    for i := range count {
+        adr := start + uint16(i)
+        cmd, err := d.p.GetCommand(adr)
+        if err != nil {
+            return
+        }
+        mark := "  "
+        if adr == d.p.GetPc() {
+            mark = "=>"
+        }
+        if d.breaks[adr] {
+            mark += "*"
+        } else {
+            mark += " "
+        }
+        fmt.Printf("%v %5d: %v\n", mark, adr, d.p.ISA().Disassemble(cmd))
+    }
+}
+
+func (d *debugger) pipe() {
+    for _, s := range d.p.GetStages() {
+        cmd := "bubble"
+        if s.Stall {
+            cmd = "stall"
+        } else if s.Valid {
+            cmd = fmt.Sprintf("%d: %v", s.Adr, d.p.ISA().Disassemble(s.Cmd))
+        }
+        fmt.Printf("%-10v %-24v OP1:%v OP2:%v RES:%v\n", s.Name, cmd, s.Alu.Op1, s.Alu.Op2, s.Alu.Res)
+    }
+}
+
+//Count from x/N, 1 if it's just x
+func parseCount(s string) (int, error) {
+    _, n, found := strings.Cut(s, "/")
+    if !found {
+        return 1, nil
+    }
+    return strconv.Atoi(n)
+}
+
+func (d *debugger) exec(args []string) error {
+    if len(args) == 0 {
+        d.run(1, nil)
+        return nil
+    }
+    switch cmd := args[0]; {
+    case cmd == "help":
+        fmt.Println(debugHelp)
+
+    case cmd == "step" || cmd == "s":
+        n := 1
+        if len(args) > 1 {
+            var err error
+            if n, err = strconv.Atoi(args[1]); err != nil {
+                return err
+            }
+        }
+        d.run(n, nil)
+
+    case cmd == "stepi":
+        retired := d.p.GetStats().Retired
+        d.run(-1, func() bool { return d.p.GetStats().Retired != retired })
+
+    case cmd == "continue" || cmd == "c":
+        d.run(-1, nil)
+
+    case cmd == "break" || cmd == "b":
+        if len(args) != 2 {
+            return fmt.Errorf("Expected break <pc>")
+        }
+        adr, err := strconv.ParseUint(args[1], 10, 16)
+        if err != nil {
+            return err
+        }
+        if _, err := d.p.GetCommand(uint16(adr)); err != nil {
+            return err
+        }
+        d.breaks[uint16(adr)] = true
+        fmt.Printf("Breakpoint at %d\n", adr)
+
+    case cmd == "watch":
+        if len(args) != 2 {
+            return fmt.Errorf("Expected watch r<n> or watch mem[<adr>]")
+        }
+        l, err := parseLoc(args[1])
+        if err != nil {
+            return err
+        }
+        val, err := d.value(l)
+        if err != nil {
+            return err
+        }
+        d.watches = append(d.watches, watch{l, val})
+        fmt.Printf("Watchpoint %v = %d\n", l.name, val)
+
+    case cmd == "print" || cmd == "p":
+        if len(args) != 2 {
+            return fmt.Errorf("Expected print r<n>, mem[<adr>], pc, sp or flags")
+        }
+        l, err := parseLoc(args[1])
+        if err != nil {
+            return err
+        }
+        val, err := d.value(l)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%v = %d\n", l.name, val)
+
+    case cmd == "x" || strings.HasPrefix(cmd, "x/"):
+        count, err := parseCount(cmd)
+        if err != nil {
+            return err
+        }
+        if len(args) != 3 || (args[1] != "mem" && args[1] != "cmd") {
+            return fmt.Errorf("Expected x/N mem <adr> or x/N cmd <adr>")
+        }
+        start, err := strconv.ParseUint(args[2], 10, 16)
+        if err != nil {
+            return err
+        }
+        return d.examine(count, args[1], uint16(start))
+
+    case cmd == "disas":
+        start, count := d.p.GetPc(), 10
+        if len(args) > 1 {
+            adr, err := strconv.ParseUint(args[1], 10, 16)
+            if err != nil {
+                return err
+            }
+            start = uint16(adr)
+        }
+        if len(args) > 2 {
+            var err error
+            if count, err = strconv.Atoi(args[2]); err != nil {
+                return err
+            }
+        }
+        d.disas(start, count)
+
+    case cmd == "pipe":
+        d.pipe()
+
+    case cmd == "stats":
+        fmt.Print(d.p.GetStats())
+
+    case cmd == "trace":
+        d.p.DebugMode = !d.p.DebugMode
+        fmt.Println("Trace:", d.p.DebugMode)
+
+    default:
+        return fmt.Errorf("Unknown command %v, type help to see commands", cmd)
+    }
+    return nil
+}
+
+func Debug(p *cpu.Pennywise700, limit int) {
+    d := &debugger{p: p, limit: limit, breaks: make(map[uint16]bool)}
+    fmt.Println("Enter - step for next cycle\nhelp - list of commands\nq - to exit")
+    scanner := bufio.NewScanner(os.Stdin)
+    for {
+        fmt.Print("(pw) ")
+        if !scanner.Scan() {
+            return
+        }
+        args := strings.Fields(scanner.Text())
+        if len(args) > 0 && args[0] == "q" {
+            return
+        }
+        if err := d.exec(args); err != nil {
+            fmt.Println(err)
+        }
+    }
+}
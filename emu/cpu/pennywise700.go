@@ -2,314 +2,1434 @@ package cpu
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/bits"
 	"os"
-	"strconv"
-	"sync"
+	"slices"
 
+	"github.com/Tyulenb/Pennywise700/diagram"
+	"github.com/Tyulenb/Pennywise700/isa"
 	"github.com/Tyulenb/Pennywise700/pipeline"
+	"github.com/Tyulenb/Pennywise700/predict"
+	"github.com/Tyulenb/Pennywise700/stats"
 )
 
-const (
-    NOP = iota
-    LTM
-    MTR
-    RTR
-    SUB
-    JUMP_LESS
-    MTRK
-    RTMK
-    JMP
-    SUM
-)
-
-
 type Pennywise700 struct {
 	//memory of commands
-	cmd_mem  [1024]uint32
+	cmd_mem  []uint32
 	//main memory
-	mem      [1024]uint16
+	mem      []uint16
 	//registers
-	RF       [16]uint16
+	RF       []uint16
+	//Instruction set with sizes of machine
+	set      *isa.ISA
+	//zero, carry, overflow and negative flags of the last ALU result
+	flags    uint16
 	//program counter
 	pc       uint16
     pc_stop  bool
+    //HALT was fetched, nothing else is fetched
+    draining bool
+    //HALT reached write back
+    halted   bool
+    //Cycles command on Execute still needs, 0 if it's done
+    exec_left int
+    //Exception which stopped the machine, nil if there is none
+    fault    *Exception
+    //The last exception, it's kept when handler takes it
+    last     *Exception
+    //Exceptions go to handler if vectored is set
+    handler  uint16
+    vectored bool
+    //Cycles MUL and DIV with MOD stay on Execute
+    MulCycles int
+    DivCycles int
+    //Paths results are forwarded by to decode stages
+    Forwarding Forwarding
+    //Stages jumps are resolved on, write back by default
+    Resolution Resolution
+    //Tells fetch where to go after jumps, nil predicts that every jump falls through
+    Predictor predict.Predictor
     ignoreWR uint8
     DebugMode bool
+    //Output of console device, it's dropped if nil
+    Console  io.Writer
+    //Input device, SetInput gives it a reader
+    input    input
 	pipeline *pipeline.Pipeline
+    stats    *stats.Counters
+    //Pipeline of every cycle, nil if it's not recorded
+    diagram  *diagram.Diagram
 }
 
+//Machine of default config, 1024 cells of memory and commands and 16 registers
 func NewPennywise700() *Pennywise700 {
-    pipeline := pipeline.NewPipeline(5) //Since we have 5 stages
+    return newMachine(isa.Default)
+}
+
+//Machine with given sizes of memory, command memory and register file
+func New(c isa.Config) (*Pennywise700, error) {
+    set, err := isa.New(c)
+    if err != nil {
+        return nil, err
+    }
+    return newMachine(set), nil
+}
+
+func newMachine(set *isa.ISA) *Pennywise700 {
+    pipeline := pipeline.NewPipeline(5, set) //Since we have 5 stages
     p := &Pennywise700{
         pc: 0,
+        cmd_mem: make([]uint32, set.Cmd),
+        mem: make([]uint16, set.Mem),
+        RF: make([]uint16, set.Regs),
+        set: set,
         pipeline: pipeline,
+        stats: stats.New(),
+        MulCycles: 4,
+        DivCycles: 8,
+        Forwarding: ForwardWB,
+        Predictor: predict.NotTaken{},
     }
     p.RF[1] = 1
+    //Stack is empty, it grows down from the devices
+    p.RF[set.SP] = p.Port(IOBase)
     return p
 }
 
+//Memory mapped devices take the last cells of memory
+//Addresses are given for memory of 1024 cells, Port gives them for other sizes
+const (
+    //Low byte of value written here is put to Console as a character
+    PortChar = 1020
+    //Value written here is put to Console as a decimal number on its own line
+    PortNum  = 1021
+    //Read gives the next number of input, InputEOF when it's over
+    PortIn   = 1022
+    //Read gives code of the last exception, index in Causes plus one, 0 if there was none
+    PortCause = 1023
+    //Cells from IOBase to the end of memory are reserved for devices
+    IOBase   = PortChar
+)
+
+//Address of port in memory of the machine
+func (p *Pennywise700) Port(port uint16) uint16 {
+    return uint16(len(p.mem)) - (1024 - port)
+}
+
+//Port at address as it's given for memory of 1024 cells, 0 for memory cells
+func (p *Pennywise700) device(adr uint16) uint16 {
+    if adr < p.Port(IOBase) {
+        return 0
+    }
+    return adr + (1024 - uint16(len(p.mem)))
+}
+
+//Write to data memory, writes to ports go to devices instead of cells
+func (p *Pennywise700) store(adr uint16, val uint16) {
+    switch p.device(adr) {
+    case PortChar:
+        p.print(string(rune(byte(val))))
+    case PortNum:
+        p.print(fmt.Sprintf("%d\n", val))
+    default:
+        p.mem[adr] = val
+    }
+}
+
+//Output errors don't stop the machine
+func (p *Pennywise700) print(text string) {
+    if p.Console != nil {
+        io.WriteString(p.Console, text)
+    }
+}
+
+//Value read from input port when input is over
+const InputEOF = 0xFFFF
+
+//Input device, numbers separated by spaces or new lines are taken one by one
+type input struct {
+    r     *bufio.Reader
+    //Next number, it's read ahead and kept until a command takes it
+    val   uint16
+    ready bool
+    eof   bool
+    err   error
+}
+
+//Next number without taking it, InputEOF if there are no more
+func (in *input) peek() (uint16, error) {
+    if in.ready || in.err != nil {
+        return in.val, in.err
+    }
+    in.ready, in.val = true, InputEOF
+    if in.r == nil {
+        in.eof = true
+        return in.val, nil
+    }
+    var n int
+    _, err := fmt.Fscan(in.r, &n)
+    switch {
+    case err == io.EOF:
+        in.eof = true
+    case err != nil:
+        in.err = fmt.Errorf("%w: %v", ErrInput, err)
+    case n < -0x8000 || n > 0xFFFF:
+        in.err = fmt.Errorf("%w: %d doesn't fit in a word", ErrInput, n)
+    case uint16(n) == InputEOF:
+        //Program couldn't tell it from the end of input
+        in.err = fmt.Errorf("%w: %d is the same word as the end of input", ErrInput, n)
+    default:
+        in.val = uint16(n)
+    }
+    return in.val, in.err
+}
+
+//Number is taken, the next one is read on the next peek, input stays over after InputEOF
+func (in *input) take() {
+    if !in.eof {
+        in.ready = false
+    }
+}
+
+//Read from data memory, reads of ports go to devices instead of cells
+func (p *Pennywise700) load(adr uint16) uint16 {
+    switch p.device(adr) {
+    case PortIn:
+        val, _ := p.input.peek()
+        return val
+    case PortCause:
+        return p.last.code()
+    }
+    return p.mem[adr]
+}
+
+//Command on write back takes a number from input
+//Devices are read on write back, so commands dropped by a jump don't take input
+func (p *Pennywise700) takesInput() bool {
+    stage := 4
+    switch p.pipeline.Op(stage) {
+    case isa.MTR:
+        return p.device(p.pipeline.DecodeAdrM(stage)) == PortIn
+    case isa.MTRK:
+        return p.device(p.pipeline.Alu[stage].Res) == PortIn
+    }
+    return false
+}
+
+//Exception is precise: commands before the faulting one are done and commands after it are not
+type Exception struct {
+    //One of Causes, it can be wrapped with details
+    Cause error
+    //Address and word of the faulting command
+    Pc    uint16
+    Cmd   uint32
+    //Assembly language form of command
+    text  string
+}
+
+func (e *Exception) Error() string {
+    return fmt.Sprintf("%v: %v at address %d", e.Cause, e.text, e.Pc)
+}
+
+func (e *Exception) Unwrap() error {
+    return e.Cause
+}
+
+//Code read from PortCause
+func (e *Exception) code() uint16 {
+    if e == nil {
+        return 0
+    }
+    for i, cause := range Causes {
+        if errors.Is(e.Cause, cause) {
+            return uint16(i+1)
+        }
+    }
+    return 0
+}
+
+//Exception of command on stage
+func (p *Pennywise700) exception(stage int, cause error) *Exception {
+    cmd := p.pipeline.Pipe[stage]
+    text := p.set.Disassemble(cmd)
+    if text == "" {
+        text = fmt.Sprintf("%0*b", p.set.Width, cmd)
+    }
+    return &Exception{cause, p.pipeline.Adr[stage], cmd, text}
+}
+
+//Passes exception to handler like CALL from the faulting command, so RET runs it again
+//Returns false if there is no handler or return address can't be pushed
+func (p *Pennywise700) vector(e *Exception) bool {
+    sp := p.RF[p.set.SP]
+    if !p.vectored || sp == 0 || sp > p.Port(IOBase) {
+        return false
+    }
+    p.RF[p.set.SP] = sp-1
+    p.mem[sp-1] = e.Pc
+    p.pipeline.DropPipe()
+    p.pc, p.draining, p.exec_left = p.handler, false, 0
+    return true
+}
+
+//Command at pc, NOP past the end of command memory, it raises exception on Execute
+func (p *Pennywise700) fetch(pc uint16) uint32 {
+    if int(pc) >= len(p.cmd_mem) {
+        return isa.NOP
+    }
+    return p.cmd_mem[pc]
+}
+
+// Register or memory write of command on write back
+type write struct {
+    mem bool
+    adr uint16
+    val uint16
+}
+
+// State computed by stages during a cycle
+// Stages never write machine state directly, they fill the latch
+// and everything is committed together on the clock edge
+type latch struct {
+    alu   []pipeline.ALU
+    pc    uint16
+    m3    bool
+    m4    bool
+    m5    bool
+    exec_left int
+    fault *Exception
+    //Jumps resolved on their stages
+    branches []resolved
+    halt  bool
+    //Command on write back takes a number from input
+    input bool
+    wrs   []write
+    //Events for performance counters
+    m3_hazard string
+    m4_hazard string
+    forwards  []bypass
+    //Stages which take operand from write back, and write back itself
+    forwarded [isa.WriteBack+1]bool
+    retired  bool
+}
+
+//Stages which keep their commands on the clock edge because of stalls
+func held(m3, m4, m5 bool) map[int]bool {
+    return map[int]bool{
+        isa.Decode1: m3 || m4 || m5,
+        isa.Decode2: m4 || m5,
+        isa.Execute: m5,
+    }
+}
+
+//Held stage reads its operands again on the next cycle,
+//so operands are counted as forwarded only on the cycle the command moves on
+func (next *latch) dropHeld() {
+    stalled := held(next.m3, next.m4, next.m5)
+    forwards := make([]bypass, 0, len(next.forwards))
+    next.forwarded = [isa.WriteBack+1]bool{}
+    for _, f := range next.forwards {
+        if stalled[f.to] {
+            continue
+        }
+        forwards = append(forwards, f)
+        next.forwarded[f.to] = true
+        next.forwarded[f.from] = true
+    }
+    next.forwards = forwards
+}
+
+//Operand taken by stage from a later one
+type bypass struct {
+    to   int
+    from int
+}
+
 func (p *Pennywise700) EmulateCycle() {
-    var wg sync.WaitGroup 
+    if p.halted || p.fault != nil {
+        return
+    }
+    stalled := p.pc_stop
     if p.pc_stop {
-        p.pc-=1
+        //Command stalled on Fetch is fetched again
+        p.pc = p.pipeline.Adr[0]
         p.pc_stop = false
     }
-    p.pipeline.Move(p.cmd_mem[p.pc]) //Zero stage, FETCH COMMAND
-    wg.Go(p.stageOne)
-    wg.Go(p.stageTwo)
-    wg.Go(p.stageThree)
-    wg.Go(p.stageFour)
-    wg.Wait()
+    if !p.draining {
+        p.pipeline.Move(p.fetch(p.pc), p.pc, true) //Zero stage, FETCH COMMAND
+        p.predictNext()
+    } else if stalled {
+        //HALT stalled in fetch must stay there
+        p.pipeline.Move(p.pipeline.Pipe[0], p.pipeline.Adr[0], p.pipeline.Valid[0])
+    } else {
+        p.pipeline.Move(isa.NOP, p.pc, false)
+    }
+    if p.pipeline.Op(0) == isa.HALT {
+        //Nothing is fetched after HALT, so the pipe drains
+        p.draining = true
+    }
+
+    //Every stage reads the state latched on the previous edge,
+    //decode stages also take results Execute computes in this cycle, so they go after it
+    next := &latch{
+        alu: append([]pipeline.ALU(nil), p.pipeline.Alu...),
+        pc:  p.pc,
+    }
+    p.stageThree(next)
+    p.stageFour(next)
+    p.stageOne(next)
+    p.stageTwo(next)
+    next.dropHeld()
+    if p.diagram != nil {
+        p.record(next)
+    }
+    p.commit(next)
 }
 
-//DECODE OP 1
-func (p *Pennywise700) stageOne() {
-    stage := 1
+//Adds pipe of the cycle to diagram, it's done before commit since jump drops the pipe
+func (p *Pennywise700) record(next *latch) {
+    row := make(diagram.Row, len(p.pipeline.Pipe))
+    for i := range row {
+        row[i] = diagram.Cell{
+            Cmd:     p.pipeline.Pipe[i],
+            Valid:   p.pipeline.Valid[i],
+            Stall:   p.pipeline.Stall[i],
+            Forward: next.forwarded[i],
+        }
+    }
+    p.diagram.Add(row)
+}
 
-    //fetching current command on stage one
-    p.pipeline.Mtx.Lock()
-    defer p.pipeline.Mtx.Unlock()
-    opCode := p.pipeline.FetchOpcode(stage)
-
-    //Read potential operands to be read from current stage 
-    r_adr_r, r_skip := p.pipeline.GetReadOpsD1(stage) 
-
-    //Read potential operands to be writen from next stage (Decode 2)
-    _, wD2_adr_r, d2_skip := p.pipeline.GetWriteOps(stage+1)
-    //Read potential operands to be writen from execute stage
-    _, wE_adr_r, e_skip := p.pipeline.GetWriteOps(stage+2)
-    //Read potential operands to be writen from WB stage
-    _, wB_adr_r, wB_skip := p.pipeline.GetWriteOps(stage+3)
-
-    //Checking read-write conflicts
-    if ((r_adr_r == wD2_adr_r && !d2_skip) || (r_adr_r == wE_adr_r && !e_skip)) && !r_skip { 
-        p.pipeline.M3 = true
-        p.pc_stop = true 
+//CLOCK EDGE
+func (p *Pennywise700) commit(next *latch) {
+    p.stats.Cycles++
+    if next.retired {
+        p.stats.Retire(p.pipeline.Instr(4).Mnemonic)
+    }
+    copy(p.pipeline.Alu, next.alu)
+    //Commands younger than the mispredicted jump are dropped
+    flush := 0
+    for _, r := range p.resolved(next) {
+        p.predictor().Update(r.b, r.taken, r.target)
+        p.stats.Branch(r.taken, !r.miss)
+        if r.miss {
+            next.pc, flush = r.to, r.stage
+        }
+    }
+    if next.input {
+        p.input.take()
+    }
+    for _, w := range next.wrs {
+        switch {
+        case w.mem:
+            p.store(w.adr, w.val)
+        case w.adr == isa.FlagsReg:
+            p.flags = w.val
+        default:
+            p.RF[w.adr] = w.val
+        }
+    }
+    p.pc = next.pc
+    if next.halt {
+        p.halted = true
+        return
+    }
+    if flush > 0 {
+        //Stalled commands are dropped with the pipe, so their stalls are too
+        //HALT can be dropped as well, if it was fetched on the wrong path
+        flushed := 0
+        for _, valid := range p.pipeline.Valid[:flush] {
+            if valid {
+                flushed++
+            }
+        }
+        p.stats.Flush(flushed)
+        for _, f := range next.forwards {
+            if f.to >= flush {
+                p.stats.Forward(isa.StageNames[f.from])
+            }
+        }
+        p.pipeline.DropYounger(flush)
+        p.draining = false
+        p.exec_left = 0
         return
     }
+    if next.fault != nil {
+        //Older commands are done, younger ones never change the state
+        p.last = next.fault
+        if !p.vector(next.fault) {
+            p.fault = next.fault
+        }
+        return
+    }
+    p.pipeline.M3 = next.m3
+    p.pipeline.M4 = next.m4
+    p.pipeline.M5 = next.m5
+    p.exec_left = next.exec_left
+    p.pc_stop = next.m3 || next.m4 || next.m5
+    if next.m5 {
+        p.stats.Stall(isa.StageNames[isa.Execute], stats.HazardStruct)
+    } else if next.m4 {
+        p.stats.Stall(isa.StageNames[isa.Decode2], next.m4_hazard)
+    } else if next.m3 {
+        p.stats.Stall(isa.StageNames[isa.Decode1], next.m3_hazard)
+    }
+    for _, f := range next.forwards {
+        p.stats.Forward(isa.StageNames[f.from])
+    }
+}
 
-    //execute command with alu
-    switch opCode {
-    case LTM:
-        p.pipeline.Alu[stage].Op1 = p.pipeline.DecodeLiteral(stage) 
-
-    case RTR, MTRK:
-        if r_adr_r == wB_adr_r && !r_skip && !wB_skip{
-            p.pipeline.Alu[stage].Op1 = p.pipeline.Alu[stage+3].Res
-            if p.pipeline.FetchOpcode(stage+3) == MTRK {
-                p.pipeline.Alu[stage].Op1 = p.mem[p.pipeline.Alu[stage+3].Res]
+//Paths results are forwarded by, they can be combined
+type Forwarding uint8
+
+const (
+    //Result of command on write back goes to Decode 1 and Decode 2
+    ForwardWB Forwarding = 1 << iota
+    //Result Execute computes goes to Decode 1 and Decode 2 in the same cycle
+    ForwardEX
+    //Operands are read only from registers and memory after producer leaves write back
+    ForwardNone Forwarding = 0
+    ForwardFull = ForwardWB | ForwardEX
+)
+
+var forwardingNames = map[Forwarding]string{ForwardNone: "none", ForwardWB: "wb", ForwardEX: "ex", ForwardFull: "full"}
+
+func (f Forwarding) String() string {
+    return forwardingNames[f]
+}
+
+//Forwarding by name: none, wb, ex or full
+func ParseForwarding(name string) (Forwarding, error) {
+    for f, n := range forwardingNames {
+        if n == name {
+            return f, nil
+        }
+    }
+    return 0, fmt.Errorf("Unknown forwarding %v, expected none, wb, ex or full", name)
+}
+
+//Operands are going to be written by commands which can't forward them yet
+//Returns type of the hazard
+func (p *Pennywise700) conflict(stage int, reads []pipeline.Operand, next *latch) (string, bool) {
+    last := isa.WriteBack
+    if p.Forwarding&ForwardWB == 0 {
+        last++
+    }
+    var ex []write
+    if p.Forwarding&ForwardEX != 0 {
+        ex = p.exResults(next)
+    }
+    for s := stage+1; s < last; s++ {
+        for _, w := range p.pipeline.GetWriteOps(s) {
+            if !slices.Contains(reads, w) {
+                continue
             }
-            if p.DebugMode {
-                fmt.Println("Write back was executed")
+            if s == isa.Execute && slices.ContainsFunc(ex, func(e write) bool { return e.mem == w.Mem && e.adr == w.Adr }) {
+                continue
             }
+            switch {
+            case w.Mem:
+                return stats.HazardMem, true
+            case w.Adr == isa.FlagsReg:
+                return stats.HazardFlags, true
+            }
+            return stats.HazardReg, true
+        }
+    }
+    return "", false
+}
+
+//Reads operands of command on stage to its ALU
+func (p *Pennywise700) readOps(stage int, next *latch) {
+    for _, r := range p.pipeline.Instr(stage).Reads {
+        if r.Stage != stage {
+            continue
+        }
+        if r.Op == 3 {
+            next.alu[stage].Flags = p.read(stage, r, next)
+        } else if r.Op == 2 {
+            next.alu[stage].Op2 = p.read(stage, r, next)
         } else {
-            adr_r2 := p.pipeline.DecodeAdrR2(stage)
-            p.pipeline.Alu[stage].Op1 = p.RF[adr_r2]
+            next.alu[stage].Op1 = p.read(stage, r, next)
         }
+    }
+}
 
-    case SUB, JUMP_LESS, SUM, RTMK:
-        if r_adr_r == wB_adr_r {
-            p.pipeline.Alu[stage].Op1 = p.pipeline.Alu[stage+3].Res
+//Value of operand, it's taken from write back if it writes the same place
+func (p *Pennywise700) read(stage int, r isa.Access, next *latch) uint16 {
+    adr := p.pipeline.Decode(stage, r.Field)
+    switch r.Loc {
+    case isa.StackPtr:
+        adr = p.set.SP
+        fallthrough
+    case isa.Flags:
+        if r.Loc == isa.Flags {
+            adr = isa.FlagsReg
+        }
+        fallthrough
+    case isa.Reg, isa.Mem:
+        if w, from, ok := p.forward(r.Loc == isa.Mem, adr, next); ok {
             if p.DebugMode {
-                fmt.Println("Write back was executed")
+                fmt.Printf("Operand is taken from %v\n", isa.StageNames[from])
             }
-        } else {
-            adr_r1 := p.pipeline.DecodeAdrR1(stage)
-            p.pipeline.Alu[stage].Op1 = p.RF[adr_r1]
+            next.forwards = append(next.forwards, bypass{stage, from})
+            next.forwarded[stage] = true
+            next.forwarded[from] = true
+            return w.val
+        }
+        switch {
+        case r.Loc == isa.Mem:
+            return p.mem[adr]
+        case adr == isa.FlagsReg:
+            return p.flags
         }
+        return p.RF[adr]
+    case isa.PC:
+        //Address of the next command, CALL returns there
+        return p.pipeline.Adr[stage] + 1
+    }
+    if r.Field.Kind == isa.KindInt {
+        return uint16(p.pipeline.DecodeSigned(stage, r.Field))
+    }
+    return adr
+}
 
-    case JMP:
-        p.pipeline.Alu[stage].Op1 = p.pipeline.DecodeAdrToJump(stage) 
+//Write to the same place by command on Execute or write back, which is allowed to forward it
+//Execute holds the younger command, and the last write wins if there are several
+//Returns the write and stage it comes from
+func (p *Pennywise700) forward(mem bool, adr uint16, next *latch) (write, int, bool) {
+    from := []struct {
+        stage int
+        on    bool
+        wrs   func() []write
+    }{
+        {isa.Execute, p.Forwarding&ForwardEX != 0, func() []write { return p.exResults(next) }},
+        {isa.WriteBack, p.Forwarding&ForwardWB != 0, p.results},
     }
-    if p.DebugMode {
-         fmt.Printf("\nDECODE OP1\nCMD: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), p.pipeline.Alu[stage].ToString())
+    for _, f := range from {
+        if !f.on {
+            continue
+        }
+        found, ok := write{}, false
+        for _, w := range f.wrs() {
+            if w.mem == mem && w.adr == adr {
+                found, ok = w, true
+            }
+        }
+        if ok {
+            return found, f.stage, true
+        }
     }
+    return write{}, 0, false
 }
 
-//DECODE OP 2
-func (p *Pennywise700) stageTwo() {
-    stage := 2
-    p.pipeline.Mtx.Lock()
-    defer p.pipeline.Mtx.Unlock()
-    opCode := p.pipeline.FetchOpcode(stage)
-
-    //Read potential operands to be read from current stage 
-    r_adr_m, r_adr_r, r_skip := p.pipeline.GetReadOpsD2(stage)
-    //Read potential operands to be writen from execute stage
-    wE_adr_m, wE_adr_r, e_skip := p.pipeline.GetWriteOps(stage+1)
-    //Read potential operands to be writen from WB stage
-    wB_adr_m, wB_adr_r, wB_skip := p.pipeline.GetWriteOps(stage+2)
-
-    if !r_skip && !e_skip && (r_adr_r == wE_adr_r)  {
-        p.pipeline.M4 = true  
-        p.pc_stop = true
+//DECODE OP 1
+func (p *Pennywise700) stageOne(next *latch) {
+    stage := 1
+
+    //Checking read-write conflicts with commands after Decode 1
+    if hazard, ok := p.conflict(stage, p.pipeline.GetReadOpsD1(stage), next); ok {
+        next.m3, next.m3_hazard = true, hazard
         return
     }
-    if opCode == MTR && (p.pipeline.FetchOpcode(stage+1) == RTMK) && (r_adr_m == p.RF[wE_adr_m]) && !r_skip && !e_skip{
-        p.pipeline.M4 = true  
-        p.pc_stop = true
-        return
+    p.readOps(stage, next)
+    //JMP needs only its address, it can be resolved here
+    p.resolve(stage, next.alu[stage], next)
+
+    if p.DebugMode {
+         fmt.Printf("\nDECODE OP1\nCMD: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), next.alu[stage].ToString())
     }
+}
 
-    //execute command with alu
-    switch opCode {
-    case SUB, SUM, JUMP_LESS:
-        if r_adr_r == wB_adr_r && !r_skip && !wB_skip {
-            p.pipeline.Alu[stage].Op2 = p.pipeline.Alu[stage+2].Res
-            if p.pipeline.FetchOpcode(stage+2) == MTRK {
-                p.pipeline.Alu[stage].Op2 = p.mem[p.pipeline.Alu[stage+2].Res]
-            }
-            if p.DebugMode {
-                fmt.Println("Write back was executed")
-            }
-        }else {
-            adr_r2 := p.pipeline.DecodeAdrR2(stage) 
-            p.pipeline.Alu[stage].Op2 = p.RF[adr_r2]
-        }
+//DECODE OP 2
+func (p *Pennywise700) stageTwo(next *latch) {
+    stage := 2
 
-    case MTR:
-        if !r_skip && !wB_skip && 
-            (r_adr_m == wB_adr_m || p.pipeline.FetchOpcode(stage+2) == RTMK && r_adr_m == p.RF[wB_adr_m]) {
-            p.pipeline.Alu[stage].Op1 = p.pipeline.Alu[stage+2].Res
-            if p.DebugMode {
-                fmt.Println("Write back was executed")
-            }
-        }else {
-            adr_m := p.pipeline.DecodeAdrM(stage)
-            p.pipeline.Alu[stage].Op1 = p.mem[adr_m] //In this command can write to any operand
-        }
+    //Checking read-write conflicts with commands after Decode 2
+    if hazard, ok := p.conflict(stage, p.pipeline.GetReadOpsD2(stage), next); ok {
+        next.m4, next.m4_hazard = true, hazard
+        return
     }
+    p.readOps(stage, next)
 
     if p.DebugMode {
-        fmt.Printf("\nDECODE OP2\nOpCode: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), p.pipeline.Alu[stage].ToString())
+        fmt.Printf("\nDECODE OP2\nOpCode: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), next.alu[stage].ToString())
     }
 }
 
 //EXECUTE
-func (p *Pennywise700) stageThree() {
+func (p *Pennywise700) stageThree(next *latch) {
     stage := 3
 
     //fetching current command on stage three 
-    p.pipeline.Mtx.Lock()
-    defer p.pipeline.Mtx.Unlock()
-    opCode := p.pipeline.FetchOpcode(stage)
+    opCode := p.pipeline.Op(stage)
 
+    //Command which can't be executed stops everything after it
+    if p.pipeline.Valid[stage] {
+        switch {
+        case int(p.pipeline.Adr[stage]) >= len(p.cmd_mem):
+            next.fault = p.exception(stage, ErrPcOverflow)
+            return
+        case p.set.Decode(p.pipeline.Pipe[stage]) == nil:
+            next.fault = p.exception(stage, ErrIllegalCommand)
+            return
+        }
+    }
+    //Indirect address is read on Decode 1
+    in := p.pipeline.Instr(stage)
+    if adr := p.pipeline.Alu[stage].Op1; (in.ReadsFrom(isa.MemInd) || in.WritesTo(isa.MemInd)) && int(adr) >= len(p.mem) {
+        next.fault = p.exception(stage, fmt.Errorf("%w %d", ErrBadAddress, adr))
+        return
+    }
+
+    //Multi-cycle command holds Execute and everything before it
+    if cycles := p.execCycles(opCode); cycles > 1 {
+        left := p.exec_left
+        if left == 0 {
+            left = cycles
+        }
+        left--
+        if left > 0 {
+            next.m5, next.exec_left = true, left
+            return
+        }
+    }
 
     //execute command with alu
     switch opCode {
-    case LTM, MTR, RTR, MTRK, RTMK, JMP:
-        p.pipeline.Alu[stage].Res = p.pipeline.Alu[stage].Op1
+    case isa.LTM, isa.MTR, isa.LTR, isa.RTR, isa.MTRK, isa.RTMK, isa.JMP, isa.JR:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1
+
+    case isa.SUB:
+       next.alu[stage].Res = p.pipeline.Alu[stage].Op1 - p.pipeline.Alu[stage].Op2 
+
+    case isa.SUM, isa.ADDI:
+       next.alu[stage].Res = p.pipeline.Alu[stage].Op2 + p.pipeline.Alu[stage].Op1 
+
+    case isa.AND:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 & p.pipeline.Alu[stage].Op2
+
+    case isa.OR:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 | p.pipeline.Alu[stage].Op2
+
+    case isa.XOR:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 ^ p.pipeline.Alu[stage].Op2
+
+    case isa.NOT:
+        next.alu[stage].Res = ^p.pipeline.Alu[stage].Op1
+
+    case isa.SHL, isa.SHLI:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 << p.pipeline.Alu[stage].Op2
+
+    case isa.SHR, isa.SHRI:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 >> p.pipeline.Alu[stage].Op2
 
-    case SUB:
-       p.pipeline.Alu[stage].Res = p.pipeline.Alu[stage].Op1 - p.pipeline.Alu[stage].Op2 
+    case isa.SAR, isa.SARI:
+        //Sign bit is copied to the vacated bits
+        next.alu[stage].Res = uint16(int16(p.pipeline.Alu[stage].Op1) >> p.pipeline.Alu[stage].Op2)
 
-    case SUM:
-       p.pipeline.Alu[stage].Res = p.pipeline.Alu[stage].Op2 + p.pipeline.Alu[stage].Op1 
+    case isa.ROL, isa.ROLI:
+        next.alu[stage].Res = bits.RotateLeft16(p.pipeline.Alu[stage].Op1, int(p.pipeline.Alu[stage].Op2 % 16))
 
-    case JUMP_LESS:
-        if p.pipeline.Alu[stage].Op1 >= p.pipeline.Alu[stage].Op2 {
-            p.pipeline.Alu[stage].Res = 1 
+    case isa.ROR, isa.RORI:
+        next.alu[stage].Res = bits.RotateLeft16(p.pipeline.Alu[stage].Op1, -int(p.pipeline.Alu[stage].Op2 % 16))
+
+    case isa.MUL:
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 * p.pipeline.Alu[stage].Op2
+
+    case isa.DIV, isa.MOD:
+        if p.pipeline.Alu[stage].Op2 == 0 {
+            next.fault = p.exception(stage, ErrDivideByZero)
+        } else if opCode == isa.DIV {
+            next.alu[stage].Res = p.pipeline.Alu[stage].Op1 / p.pipeline.Alu[stage].Op2
+        } else {
+            next.alu[stage].Res = p.pipeline.Alu[stage].Op1 % p.pipeline.Alu[stage].Op2
+        }
+
+    case isa.PUSH, isa.CALL:
+        if sp := p.pipeline.Alu[stage].Op1; sp == 0 || sp > p.Port(IOBase) {
+            next.fault = p.exception(stage, fmt.Errorf("%w with SP %d", ErrStackOverflow, sp))
+        }
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 - 1
+
+    case isa.POP, isa.RET:
+        if sp := p.pipeline.Alu[stage].Op1; sp >= p.Port(IOBase) {
+            next.fault = p.exception(stage, fmt.Errorf("%w with SP %d", ErrStackUnderflow, sp))
+        }
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1
+
+    case isa.ADC:
+        carry := p.pipeline.Alu[stage].Flags & isa.FlagC / isa.FlagC
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 + p.pipeline.Alu[stage].Op2 + carry
+
+    case isa.SBC:
+        borrow := p.pipeline.Alu[stage].Flags & isa.FlagC / isa.FlagC
+        next.alu[stage].Res = p.pipeline.Alu[stage].Op1 - p.pipeline.Alu[stage].Op2 - borrow
+
+    case isa.JGEU, isa.JLTU, isa.JEQ, isa.JNE, isa.JGE, isa.JLT:
+        if condition(opCode, p.pipeline.Alu[stage].Op1, p.pipeline.Alu[stage].Op2) {
+            next.alu[stage].Res = 1 
         }else{
-            p.pipeline.Alu[stage].Res = 0
+            next.alu[stage].Res = 0
         }
+
+    case isa.JZ, isa.JNZ, isa.JC, isa.JNC, isa.JN, isa.JNN, isa.JV, isa.JNV:
+        if flagCondition(opCode, p.pipeline.Alu[stage].Flags) {
+            next.alu[stage].Res = 1
+        }else{
+            next.alu[stage].Res = 0
+        }
+    }
+    if p.pipeline.Instr(stage).WritesTo(isa.Flags) {
+        next.alu[stage].Flags = aluFlags(opCode, p.pipeline.Alu[stage], next.alu[stage].Res)
     }
+    //Operands of conditional jump are already read by decode stages, they wait for them like other commands
+    p.resolve(stage, next.alu[stage], next)
     if p.DebugMode {
-        fmt.Printf("\nEXECUTE\nOpCode: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), p.pipeline.Alu[stage].ToString())
+        fmt.Printf("\nEXECUTE\nOpCode: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), next.alu[stage].ToString())
+    }
+}
+
+//Condition of conditional jump, JGE and JLT compare signed values
+func condition(op int, op1, op2 uint16) bool {
+    switch op {
+    case isa.JGEU:
+        return op1 >= op2
+    case isa.JLTU:
+        return op1 < op2
+    case isa.JEQ:
+        return op1 == op2
+    case isa.JNE:
+        return op1 != op2
+    case isa.JGE:
+        return int16(op1) >= int16(op2)
+    case isa.JLT:
+        return int16(op1) < int16(op2)
+    }
+    return false
+}
+
+//Flags of jump condition are set
+func flagCondition(op int, flags uint16) bool {
+    switch op {
+    case isa.JZ:
+        return flags & isa.FlagZ != 0
+    case isa.JNZ:
+        return flags & isa.FlagZ == 0
+    case isa.JC:
+        return flags & isa.FlagC != 0
+    case isa.JNC:
+        return flags & isa.FlagC == 0
+    case isa.JN:
+        return flags & isa.FlagN != 0
+    case isa.JNN:
+        return flags & isa.FlagN == 0
+    case isa.JV:
+        return flags & isa.FlagV != 0
+    case isa.JNV:
+        return flags & isa.FlagV == 0
+    }
+    return false
+}
+
+//Flags of ALU result, overflow is set only by additions and subtractions
+//Carry is set by them and by shifts, ADC and SBC take carry from flags they have read
+func aluFlags(op int, alu pipeline.ALU, res uint16) uint16 {
+    var flags, carry uint16
+    if op == isa.ADC || op == isa.SBC {
+        carry = alu.Flags & isa.FlagC / isa.FlagC
+    }
+    if res == 0 {
+        flags |= isa.FlagZ
+    }
+    if res & 0x8000 != 0 {
+        flags |= isa.FlagN
+    }
+    switch op {
+    case isa.SUM, isa.ADDI, isa.ADC:
+        if uint32(alu.Op1) + uint32(alu.Op2) + uint32(carry) > 0xFFFF {
+            flags |= isa.FlagC
+        }
+        //Operands of the same sign give result of the other sign
+        if (alu.Op1 ^ res) & (alu.Op2 ^ res) & 0x8000 != 0 {
+            flags |= isa.FlagV
+        }
+    case isa.SUB, isa.SBC:
+        if uint32(alu.Op1) < uint32(alu.Op2) + uint32(carry) {
+            flags |= isa.FlagC
+        }
+        //Operands of different signs give result of the sign of subtrahend
+        if (alu.Op1 ^ alu.Op2) & (alu.Op1 ^ res) & 0x8000 != 0 {
+            flags |= isa.FlagV
+        }
+    case isa.SHL, isa.SHR, isa.SAR, isa.ROL, isa.ROR,
+        isa.SHLI, isa.SHRI, isa.SARI, isa.ROLI, isa.RORI:
+        if shiftCarry(op, alu.Op1, alu.Op2) {
+            flags |= isa.FlagC
+        }
     }
+    return flags
+}
+
+//The last bit shifted out of val, it's clear if nothing is shifted
+//Shift by more than 16 gives out only fill bits, rotate puts the bit to the other end
+func shiftCarry(op int, val uint16, n uint16) bool {
+    if n == 0 {
+        return false
+    }
+    switch op {
+    case isa.SHL, isa.SHLI:
+        return n <= 16 && val >> (16-n) & 1 != 0
+    case isa.SHR, isa.SHRI:
+        return n <= 16 && val >> (n-1) & 1 != 0
+    case isa.SAR, isa.SARI:
+        return int16(val) >> (min(n, 16)-1) & 1 != 0
+    case isa.ROL, isa.ROLI:
+        return bits.RotateLeft16(val, int(n % 16)) & 1 != 0
+    case isa.ROR, isa.RORI:
+        return bits.RotateLeft16(val, -int(n % 16)) & 0x8000 != 0
+    }
+    return false
+}
+
+var (
+    ErrDivideByZero   = errors.New("Divide by zero")
+    //Push to full memory
+    ErrStackOverflow  = errors.New("Stack overflow")
+    //Pop from empty stack
+    ErrStackUnderflow = errors.New("Stack underflow")
+    //Input is not a number or it doesn't fit in a word
+    ErrInput          = errors.New("Bad input")
+    //Indirect address is out of memory
+    ErrBadAddress     = errors.New("Address out of memory")
+    //Opcode or function is unknown
+    ErrIllegalCommand = errors.New("Illegal command")
+    //Command is fetched past the end of command memory
+    ErrPcOverflow     = errors.New("PC out of command memory")
+)
+
+//Causes of exceptions in order of their codes, codes start from 1
+var Causes = []error{
+    ErrDivideByZero, ErrStackOverflow, ErrStackUnderflow, ErrInput,
+    ErrBadAddress, ErrIllegalCommand, ErrPcOverflow,
+}
+
+//Cycles command stays on Execute
+func (p *Pennywise700) execCycles(op int) int {
+    switch op {
+    case isa.MUL:
+        return p.MulCycles
+    case isa.DIV, isa.MOD:
+        return p.DivCycles
+    }
+    return 1
+}
+
+//Register, memory and flags writes of command on write back, in order they are done
+//They are commited on the clock edge and forwarded to decode stages in the same cycle
+func (p *Pennywise700) results() []write {
+    return p.writes(isa.WriteBack, p.pipeline.Alu[isa.WriteBack])
+}
+
+//Writes of command on Execute with result of this cycle, which can be forwarded
+//Values read on write back, from memory or devices, are not known yet
+func (p *Pennywise700) exResults(next *latch) []write {
+    stage := isa.Execute
+    if !p.pipeline.Valid[stage] || next.m5 || next.fault != nil {
+        return nil
+    }
+    switch p.pipeline.Op(stage) {
+    case isa.MTRK, isa.RTMK:
+        return nil
+    case isa.MTR:
+        if p.device(p.pipeline.DecodeAdrM(stage)) != 0 {
+            return nil
+        }
+    case isa.POP:
+        //Only SP is known
+        return p.writes(stage, next.alu[stage])[:1]
+    }
+    return p.writes(stage, next.alu[stage])
+}
+
+//Writes of command on stage with given ALU
+func (p *Pennywise700) writes(stage int, alu pipeline.ALU) []write {
+    res := alu.Res
+    var wrs []write
+    switch p.pipeline.Op(stage) {
+    case isa.LTM:
+        wrs = []write{{true, p.pipeline.DecodeAdrM(stage), res}}
+    case isa.MTR:
+        //Devices are read on write back instead of Decode 2
+        if adr := p.pipeline.DecodeAdrM(stage); p.device(adr) != 0 {
+            res = p.load(adr)
+        }
+        wrs = []write{{false, p.pipeline.DecodeAdrR1(stage), res}}
+    case isa.LTR, isa.ADDI, isa.RTR, isa.NOT:
+        wrs = []write{{false, p.pipeline.DecodeAdrR1(stage), res}}
+    case isa.SUB, isa.SUM, isa.AND, isa.OR, isa.XOR,
+        isa.SHL, isa.SHR, isa.SAR, isa.ROL, isa.ROR,
+        isa.SHLI, isa.SHRI, isa.SARI, isa.ROLI, isa.RORI,
+        isa.MUL, isa.DIV, isa.MOD, isa.ADC, isa.SBC:
+        wrs = []write{{false, p.pipeline.DecodeAdrR3(stage), res}}
+    case isa.MTRK:
+        wrs = []write{{false, p.pipeline.DecodeAdrR1(stage), p.load(res)}}
+    case isa.RTMK:
+        wrs = []write{{true, res, p.RF[p.pipeline.DecodeAdrR2(stage)]}}
+    case isa.PUSH, isa.CALL:
+        //Value is pushed to the cell below the top, it becomes the new top
+        wrs = []write{{true, res, alu.Op2}, {false, p.set.SP, res}}
+    case isa.POP:
+        //Popped value wins if it's popped to SP
+        wrs = []write{{false, p.set.SP, res+1}, {false, p.pipeline.DecodeAdrR1(stage), p.mem[res]}}
+    case isa.RET:
+        wrs = []write{{false, p.set.SP, res+1}}
+    }
+    if p.pipeline.Instr(stage).WritesTo(isa.Flags) {
+        wrs = append(wrs, write{false, isa.FlagsReg, alu.Flags})
+    }
+    return wrs
 }
 
 //WRITEBACK
-func (p *Pennywise700) stageFour() {
+func (p *Pennywise700) stageFour(next *latch) {
     stage := 4
     //fetching current command on stage four 
-    p.pipeline.Mtx.Lock()
-    defer p.pipeline.Mtx.Unlock()
-    opCode := p.pipeline.FetchOpcode(stage) 
+    opCode := p.pipeline.Op(stage)
 
-    //execute command with alu
-    switch opCode{
-    case LTM:
-        adr_m1 := p.pipeline.DecodeAdrM(stage) 
-        p.mem[adr_m1] = p.pipeline.Alu[stage].Res
-        p.pc += 1
-
-    case MTR, RTR:
-        adr_r1 := p.pipeline.DecodeAdrR1(stage)
-        p.RF[adr_r1] = p.pipeline.Alu[stage].Res
-        p.pc += 1 
-
-    case SUB, SUM:
-        adr_r3 := p.pipeline.DecodeAdrR3(stage)
-        p.RF[adr_r3] = p.pipeline.Alu[stage].Res
-        p.pc += 1
-
-    case JUMP_LESS:
-        if p.pipeline.Alu[stage].Res == 1 {
-            p.pc = p.pipeline.DecodeAdrToJump(stage) 
-            //Ignore all commands in pipe if jump
-            p.pipeline.DropPipe()
-        }else {
-            p.pc += 1
-        }
-
-    case MTRK:
-        adr_r1 := p.pipeline.DecodeAdrR1(stage)
-        p.RF[adr_r1] = p.mem[p.pipeline.Alu[stage].Res]
-        p.pc += 1
-
-    case RTMK:
-        adr_r2 := p.pipeline.DecodeAdrR2(stage) 
-        p.mem[p.pipeline.Alu[stage].Res] = p.RF[adr_r2]
-        p.pc += 1
-
-    case JMP:
-        //Ignore all commands in pipe if jump
-        p.pipeline.DropPipe()
-        p.pc = p.pipeline.Alu[stage].Res
+    if p.takesInput() {
+        //Bad input stops the machine before the command is done
+        if _, err := p.input.peek(); err != nil {
+            next.fault = p.exception(stage, err)
+            return
+        }
+        next.input = true
+    }
+    next.wrs = p.results()
+    next.retired = p.pipeline.Valid[stage]
+    if opCode == isa.HALT {
+        //All older commands are already done, machine stops
+        next.halt = true
+    } else {
+        //Fetch goes on where it was told to go, commit turns it if a jump went another way
+        next.pc = p.pipeline.Next[isa.Fetch]
+        p.resolve(stage, p.pipeline.Alu[stage], next)
+    }
+    if p.DebugMode {
+        fmt.Printf("\nWRITEBACK\nOpCode: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), next.alu[stage].ToString())
+    }
+}
+
+//Jump, the way it went and the way fetch went after it
+type resolved struct {
+    stage  int
+    b      predict.Branch
+    taken  bool
+    target uint16
+    //Address of the next command
+    to     uint16
+    //Commands after the jump are fetched from the wrong place
+    miss   bool
+}
+
+//Stages jumps are resolved on
+type Resolution uint8
+
+const (
+    //Every jump is resolved on write back
+    ResolveWB Resolution = iota
+    //JMP is resolved on Decode 1 and conditional jumps on Execute, the rest on write back
+    ResolveEarly
+)
 
+var resolutionNames = map[Resolution]string{ResolveWB: "wb", ResolveEarly: "early"}
+
+func (r Resolution) String() string {
+    return resolutionNames[r]
+}
+
+//Resolution by name: wb or early
+func ParseResolution(name string) (Resolution, error) {
+    for r, n := range resolutionNames {
+        if n == name {
+            return r, nil
+        }
+    }
+    return 0, fmt.Errorf("Unknown resolution %v, expected wb or early", name)
+}
+
+//Stage jump is resolved on
+func (p *Pennywise700) resolvesOn(op int) int {
+    if p.Resolution == ResolveEarly {
+        switch op {
+        case isa.JMP:
+            return isa.Decode1
+        case isa.JGEU, isa.JLTU, isa.JEQ, isa.JNE, isa.JGE, isa.JLT,
+            isa.JZ, isa.JNZ, isa.JC, isa.JNC, isa.JN, isa.JNN, isa.JV, isa.JNV:
+            return isa.Execute
+        }
+    }
+    return isa.WriteBack
+}
+
+//Predictor of machine, every jump falls through without it
+func (p *Pennywise700) predictor() predict.Predictor {
+    if p.Predictor == nil {
+        return predict.NotTaken{}
+    }
+    return p.Predictor
+}
+
+//Jump on stage as predictor sees it, false if command doesn't jump
+func (p *Pennywise700) branch(stage int) (predict.Branch, bool) {
+    in := p.pipeline.Instr(stage)
+    if !p.pipeline.Valid[stage] || !in.WritesTo(isa.PC) {
+        return predict.Branch{}, false
+    }
+    b := predict.Branch{Pc: p.pipeline.Adr[stage]}
+    switch in.ID {
+    case isa.JMP, isa.CALL, isa.JR, isa.RET:
+        b.Always = true
+    }
+    for _, f := range in.Operands {
+        if f.Kind == isa.KindCmd {
+            b.Direct, b.Target = true, p.pipeline.Decode(stage, f)
+        }
+    }
+    return b, true
+}
+
+//Jump just fetched goes where predictor says
+func (p *Pennywise700) predictNext() {
+    b, ok := p.branch(isa.Fetch)
+    if !ok {
+        return
+    }
+    if taken, target := p.predictor().Predict(b); taken {
+        p.pipeline.Next[isa.Fetch] = target
+    }
+}
+
+//Checks jump on stage against the address fetched after it, if the jump is resolved there
+//Condition of the jump is in alu, JMP on Decode 1 needs none
+func (p *Pennywise700) resolve(stage int, alu pipeline.ALU, next *latch) {
+    b, ok := p.branch(stage)
+    op := p.pipeline.Op(stage)
+    if !ok || p.resolvesOn(op) != stage {
+        return
+    }
+    taken, target := true, p.pipeline.DecodeAdrToJump(stage)
+    switch op {
+    case isa.JR:
+        target = alu.Res
+    case isa.RET:
+        //Return address is on top of stack
+        target = p.mem[alu.Res]
+    case isa.JMP, isa.CALL:
     default:
-        p.pc += 1
+        taken = alu.Res == 1
     }
-    if p.DebugMode {
-        fmt.Printf("\nWRITEBACK\nOpCode: %v\nALU:\n %v\n", p.pipeline.CommandToString(stage), p.pipeline.Alu[stage].ToString())
+    r := resolved{stage: stage, b: b, taken: taken, target: target, to: p.pipeline.Adr[stage] + 1}
+    if taken {
+        r.to = target
     }
+    r.miss = r.to != p.pipeline.Next[stage]
+    if r.miss && p.DebugMode {
+        fmt.Printf("\nMISPREDICTION on %v\nFetch goes to %v\n", isa.StageNames[stage], r.to)
+    }
+    next.branches = append(next.branches, r)
 }
 
-func (p *Pennywise700) Load(path string) {
+//Jumps which take effect on the clock edge, from the oldest one
+//Jump doesn't if it's held by stall, or dropped by fault or by an older mispredicted jump
+func (p *Pennywise700) resolved(next *latch) []resolved {
+    held := held(next.m3, next.m4, next.m5)
+    rs := slices.SortedFunc(slices.Values(next.branches), func(a, b resolved) int { return b.stage - a.stage })
+    done := make([]resolved, 0, len(rs))
+    for _, r := range rs {
+        if held[r.stage] || r.stage < isa.WriteBack && next.fault != nil {
+            continue
+        }
+        done = append(done, r)
+        if r.miss {
+            break
+        }
+    }
+    return done
+}
+
+//Puts program to command memory from address 0, the rest of it is cleared
+//Registers, data memory and pipe are kept, Reset starts the program over
+func (p *Pennywise700) LoadProgram(cmds []uint32) error {
+    if len(cmds) > len(p.cmd_mem) {
+        return fmt.Errorf("Program of %d commands doesn't fit in command memory of %d commands", len(cmds), len(p.cmd_mem))
+    }
+    for i, cmd := range cmds {
+        if err := p.set.Check(cmd); err != nil {
+            return fmt.Errorf("%v at address %d", err, i)
+        }
+    }
+    clear(p.cmd_mem)
+    copy(p.cmd_mem, cmds)
+    return nil
+}
+
+//Loads program written by the translator, a line of binary digits per command
+func (p *Pennywise700) LoadFile(path string) error {
     prog, err := os.Open(path)
     if err != nil {
+        return err
+    }
+    defer prog.Close()
+    cmds, c, err := isa.ReadProgramConfig(prog)
+    if err != nil {
+        return err
+    }
+    if err := p.set.Holds(c); err != nil {
+        return err
+    }
+    return p.LoadProgram(cmds)
+}
+
+//Deprecated: errors are only logged, use LoadFile
+func (p *Pennywise700) Load(path string) {
+    if err := p.LoadFile(path); err != nil {
         log.Println(err)
-        return
     }
-    scanner := bufio.NewScanner(prog)
-    i := 0
-    for scanner.Scan() {
-        line := scanner.Text()
-        cmd, err := strconv.ParseUint(line, 2, 32)
-        if err != nil {
-            log.Println(err)
-            return
+}
+
+//Puts machine in the state NewPennywise700 gives, program in command memory, devices and settings are kept
+//Counters are cleared, diagram is started over if it's recorded, predictor keeps what it has learned
+func (p *Pennywise700) Reset() {
+    cmds, debug, record := p.cmd_mem, p.DebugMode, p.diagram != nil
+    mul, div, console, in := p.MulCycles, p.DivCycles, p.Console, p.input
+    handler, vectored, forwarding, predictor := p.handler, p.vectored, p.Forwarding, p.Predictor
+    resolution := p.Resolution
+    *p = *newMachine(p.set)
+    p.cmd_mem, p.DebugMode, p.Console, p.input = cmds, debug, console, in
+    p.handler, p.vectored, p.Forwarding, p.Predictor = handler, vectored, forwarding, predictor
+    p.Resolution = resolution
+    p.MulCycles, p.DivCycles = mul, div
+    if record {
+        p.RecordDiagram()
+    }
+}
+
+//Numbers separated by spaces or new lines are read from r by MTR and MTRK from PortIn
+//Without input, or after the end of it, InputEOF is read
+func (p *Pennywise700) SetInput(r io.Reader) {
+    p.input = input{}
+    if r != nil {
+        p.input.r = bufio.NewReader(r)
+    }
+}
+
+//Stage of pipeline as it's seen from outside
+type Stage struct {
+    Name  string
+    Cmd   uint32
+    //Address command was fetched from
+    Adr   uint16
+    //False for bubbles put in pipe by stalls and jumps
+    Valid bool
+    //Bubble put in pipe by stall
+    Stall bool
+    Alu   pipeline.ALU
+}
+
+//Command on stage can still be dropped by an older jump, which isn't resolved yet
+//Jump is resolved on the cycle it's on its resolution stage, unless the stage is held
+func (p *Pennywise700) Speculative(stage int) bool {
+    held := held(p.pipeline.M3, p.pipeline.M4, p.pipeline.M5)
+    for s := stage + 1; s < len(p.pipeline.Pipe); s++ {
+        if _, ok := p.branch(s); !ok {
+            continue
         }
-        p.cmd_mem[i] = uint32(cmd)
-        i++
+        if on := p.resolvesOn(p.pipeline.Op(s)); on > s || on == s && held[s] {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *Pennywise700) GetStages() []Stage {
+    stages := make([]Stage, len(p.pipeline.Pipe))
+    for i := range stages {
+        stages[i] = Stage{
+            Name:  isa.StageNames[i],
+            Cmd:   p.pipeline.Pipe[i],
+            Adr:   p.pipeline.Adr[i],
+            Valid: p.pipeline.Valid[i],
+            Stall: p.pipeline.Stall[i],
+            Alu:   p.pipeline.Alu[i],
+        }
+    }
+    return stages
+}
+
+func (p *Pennywise700) GetReg(r uint16) (uint16, error) {
+    if int(r) >= len(p.RF) {
+        return 0, fmt.Errorf("No register r%d, there are %d registers", r, len(p.RF))
     }
+    return p.RF[r], nil
+}
+
+//Zero, carry, overflow and negative flags, bits are isa.FlagZ, isa.FlagC, isa.FlagV and isa.FlagN
+func (p *Pennywise700) GetFlags() uint16 {
+    return p.flags
+}
+
+func (p *Pennywise700) GetMemCell(adr uint16) (uint16, error) {
+    if int(adr) >= len(p.mem) {
+        return 0, fmt.Errorf("Address %d is out of memory of %d cells", adr, len(p.mem))
+    }
+    return p.mem[adr], nil
+}
+
+func (p *Pennywise700) GetCommand(adr uint16) (uint32, error) {
+    if int(adr) >= len(p.cmd_mem) {
+        return 0, fmt.Errorf("Address %d is out of command memory of %d commands", adr, len(p.cmd_mem))
+    }
+    return p.cmd_mem[adr], nil
+}
+
+func (p *Pennywise700) SetReg(r uint16, val uint16) error {
+    if int(r) >= len(p.RF) {
+        return fmt.Errorf("No register r%d, there are %d registers", r, len(p.RF))
+    }
+    p.RF[r] = val
+    return nil
+}
+
+func (p *Pennywise700) SetMemCell(adr uint16, val uint16) error {
+    if int(adr) >= len(p.mem) {
+        return fmt.Errorf("Address %d is out of memory of %d cells", adr, len(p.mem))
+    }
+    p.mem[adr] = val
+    return nil
+}
+
+//Continues from pc like after a jump, commands which are not on write back yet are dropped
+//Halted or faulted machine goes on as well
+func (p *Pennywise700) SetPc(pc uint16) error {
+    if int(pc) >= len(p.cmd_mem) {
+        return fmt.Errorf("Address %d is out of command memory of %d commands", pc, len(p.cmd_mem))
+    }
+    p.pipeline.DropPipe()
+    p.pipeline.M3, p.pipeline.M4, p.pipeline.M5 = false, false, false
+    p.pc, p.pc_stop, p.draining, p.halted = pc, false, false, false
+    p.exec_left, p.fault = 0, nil
+    return nil
+}
+
+//Copy of machine state, it doesn't change when the machine goes on
+type State struct {
+    Pc     uint16
+    RF     []uint16
+    Flags  uint16
+    Mem    []uint16
+    Stages []Stage
+    Halted bool
+    //Fault which stopped the machine, nil if there is none
+    Fault  error
+    //The last exception, stopping or taken by handler
+    Exception *Exception
+    Cycles uint64
+}
+
+func (p *Pennywise700) State() State {
+    return State{
+        Pc:     p.pc,
+        RF:     slices.Clone(p.RF),
+        Flags:  p.flags,
+        Mem:    slices.Clone(p.mem),
+        Stages: p.GetStages(),
+        Halted: p.halted,
+        Fault:  p.Fault(),
+        Exception: p.last,
+        Cycles: p.stats.Cycles,
+    }
+}
+
+//Performance counters of everything emulated so far
+func (p *Pennywise700) GetStats() *stats.Counters {
+    return p.stats
+}
+
+//Starts recording pipeline of every cycle
+func (p *Pennywise700) RecordDiagram() {
+    if p.diagram == nil {
+        p.diagram = diagram.New(p.set)
+    }
+}
+
+//Pipeline diagram recorded since RecordDiagram, nil if it wasn't called
+func (p *Pennywise700) GetDiagram() *diagram.Diagram {
+    return p.diagram
+}
+
+//Fault which stopped the machine, nil if there is none
+//EmulateCycle does nothing after fault, it's *Exception
+func (p *Pennywise700) Fault() error {
+    if p.fault == nil {
+        return nil
+    }
+    return p.fault
+}
+
+//The last exception, stopping or taken by handler, nil if there was none
+func (p *Pennywise700) LastException() *Exception {
+    return p.last
+}
+
+//Exceptions go to command at adr instead of stopping the machine
+//Address of the faulting command is pushed to stack like by CALL, and PortCause gives the cause
+//Machine stops if the address can't be pushed
+func (p *Pennywise700) SetHandler(adr uint16) error {
+    if int(adr) >= len(p.cmd_mem) {
+        return fmt.Errorf("Address %d is out of command memory of %d commands", adr, len(p.cmd_mem))
+    }
+    p.handler, p.vectored = adr, true
+    return nil
+}
+
+//Exceptions stop the machine again
+func (p *Pennywise700) RemoveHandler() {
+    p.vectored = false
+}
+
+//HALT reached write back, EmulateCycle does nothing anymore
+func (p *Pennywise700) Halted() bool {
+    return p.halted
+}
+
+//Sizes of machine
+func (p *Pennywise700) Config() isa.Config {
+    return p.set.Config
+}
+
+//Instruction set of machine, its fields are derived from sizes
+func (p *Pennywise700) ISA() *isa.ISA {
+    return p.set
 }
 
 //SOME DEBUG PURPOSE FUNCTIONS
-func (p *Pennywise700) GetMem() [1024]uint16 {
-    return p.mem
+func (p *Pennywise700) GetMem() []uint16 {
+    return slices.Clone(p.mem)
 }
 func (p *Pennywise700) GetPc() uint16 {
     return p.pc
 }
 func (p *Pennywise700) GetCurCommand() uint32 {
-    return p.cmd_mem[p.pc]
+    return p.fetch(p.pc)
 }
 func (p *Pennywise700) GetPipeline() [5]string {
     return p.pipeline.PipeToString()
 }
-func (p *Pennywise700) GetCommands() [1024]uint32 {
-    return p.cmd_mem
+func (p *Pennywise700) GetCommands() []uint32 {
+    return slices.Clone(p.cmd_mem)
 }
@@ -0,0 +1,1086 @@
+package cpu
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Tyulenb/Pennywise700/isa"
+	"github.com/Tyulenb/Pennywise700/predict"
+	"github.com/Tyulenb/Pennywise700/stats"
+)
+
+// testdata/insertion_sort.txt is docs/insertion_sort.txt assembled by the translator
+func runInsertionSort(t *testing.T) *Pennywise700 {
+    t.Helper()
+    p := NewPennywise700()
+    if err := p.LoadFile("testdata/insertion_sort.txt"); err != nil {
+        t.Fatal(err)
+    }
+    for range 1024 {
+        p.EmulateCycle()
+    }
+    return p
+}
+
+//Insertion sort from testdata with HALT at the end
+func insertionSort(t *testing.T) []uint32 {
+    t.Helper()
+    prog, err := os.ReadFile("testdata/insertion_sort.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    sort, err := isa.ReadProgram(strings.NewReader(string(prog)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return append(sort, encode("HALT"))
+}
+
+func TestEmulateCycleDeterministic(t *testing.T) {
+    want := runInsertionSort(t)
+    mem := want.GetMem()
+    if sorted := [4]uint16{4, 5, 7, 3}; [4]uint16(mem[0:4]) != sorted {
+        t.Fatalf("MEM[0:4] = %v, want %v", mem[0:4], sorted)
+    }
+    for i := range 3000 {
+        got := runInsertionSort(t)
+        got_mem := got.GetMem()
+        if !slices.Equal(got_mem, mem) || !slices.Equal(got.RF, want.RF) || got.GetPc() != want.GetPc() {
+            t.Fatalf("run %d: state differs from first run\nMEM[0:10] %v, want %v\nREGS %v, want %v",
+                i, got_mem[0:10], mem[0:10], got.RF, want.RF)
+        }
+    }
+}
+
+func encode(mnemonic string, ops ...uint16) uint32 {
+    return isa.ByMnemonic(mnemonic).Encode(ops)
+}
+
+//Emulates until HALT, fails the test if it takes more than limit cycles
+func runUntilHalt(t *testing.T, p *Pennywise700, limit int) {
+    t.Helper()
+    for range limit {
+        if p.Halted() {
+            return
+        }
+        p.EmulateCycle()
+    }
+    t.Fatalf("no HALT in %d cycles", limit)
+}
+
+func TestLoadProgram(t *testing.T) {
+    p := NewPennywise700()
+    if err := p.LoadProgram([]uint32{encode("LTM", 9, 0), encode("LTM", 8, 1)}); err != nil {
+        t.Fatal(err)
+    }
+    prog := []uint32{encode("LTM", 5, 0), encode("HALT")}
+    if err := p.LoadProgram(prog); err != nil {
+        t.Fatal(err)
+    }
+    for adr, want := range []uint32{prog[0], prog[1], isa.NOP} {
+        if cmd, _ := p.GetCommand(uint16(adr)); cmd != want {
+            t.Errorf("command %d = %b, want %b", adr, cmd, want)
+        }
+    }
+    runUntilHalt(t, p, 100)
+    if mem := p.GetMem(); mem[0] != 5 || mem[1] != 0 {
+        t.Errorf("MEM[0:2] = %v, want [5 0]", mem[0:2])
+    }
+}
+
+func TestLoadProgramErrors(t *testing.T) {
+    p := NewPennywise700()
+    prog := []uint32{encode("LTM", 5, 0)}
+    if err := p.LoadProgram(prog); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.LoadProgram(make([]uint32, 1025)); err == nil {
+        t.Error("program of 1025 commands is loaded")
+    }
+    if err := p.LoadProgram([]uint32{1 << isa.Width}); err == nil {
+        t.Error("command wider than 24 bits is loaded")
+    }
+    if cmd, _ := p.GetCommand(0); cmd != prog[0] {
+        t.Errorf("failed load changed command 0 to %b", cmd)
+    }
+}
+
+func TestLoadFileErrors(t *testing.T) {
+    p := NewPennywise700()
+    if err := p.LoadFile("testdata/no_such_file.txt"); err == nil {
+        t.Error("missing file is loaded")
+    }
+    path := filepath.Join(t.TempDir(), "bad.txt")
+    if err := os.WriteFile(path, []byte("000100000001010000000000\nLTM 5, 0;\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.LoadFile(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+        t.Errorf("LoadFile(assembly language) = %v, want error in line 2", err)
+    }
+    if cmd, _ := p.GetCommand(0); cmd != isa.NOP {
+        t.Errorf("failed load changed command 0 to %b", cmd)
+    }
+}
+
+func TestReset(t *testing.T) {
+    want := runInsertionSort(t)
+    p := runInsertionSort(t)
+    p.Reset()
+    if s := p.State(); s.Pc != 0 || s.Cycles != 0 || s.Halted || !slices.Equal(s.RF, NewPennywise700().RF) || slices.ContainsFunc(s.Mem, func(v uint16) bool { return v != 0 }) {
+        t.Fatalf("state after Reset: pc %d, cycles %d, halted %v, REGS %v", s.Pc, s.Cycles, s.Halted, s.RF)
+    }
+    for range 1024 {
+        p.EmulateCycle()
+    }
+    got_mem, want_mem := p.GetMem(), want.GetMem()
+    if !slices.Equal(got_mem, want_mem) || !slices.Equal(p.RF, want.RF) {
+        t.Errorf("program run after Reset gives MEM[0:10] %v, want %v", got_mem[0:10], want_mem[0:10])
+    }
+}
+
+func TestSetters(t *testing.T) {
+    p := NewPennywise700()
+    if err := p.SetReg(15, 7); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.SetMemCell(1023, 9); err != nil {
+        t.Fatal(err)
+    }
+    if r, _ := p.GetReg(15); r != 7 {
+        t.Errorf("r15 = %d, want 7", r)
+    }
+    if m, _ := p.GetMemCell(1023); m != 9 {
+        t.Errorf("mem[1023] = %d, want 9", m)
+    }
+    if err := p.SetReg(16, 1); err == nil {
+        t.Error("r16 is set")
+    }
+    if err := p.SetMemCell(1024, 1); err == nil {
+        t.Error("mem[1024] is set")
+    }
+    if err := p.SetPc(1024); err == nil {
+        t.Error("pc 1024 is set")
+    }
+}
+
+func TestSetPc(t *testing.T) {
+    p := NewPennywise700()
+    err := p.LoadProgram([]uint32{
+        encode("LTM", 1, 0),
+        encode("HALT"),
+        encode("LTM", 2, 1),
+        encode("HALT"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    //Both commands are in pipe, they are dropped
+    p.EmulateCycle()
+    p.EmulateCycle()
+    if err := p.SetPc(2); err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, p, 100)
+    if mem := p.GetMem(); mem[0] != 0 || mem[1] != 2 {
+        t.Fatalf("MEM[0:2] = %v, want [0 2]", mem[0:2])
+    }
+    //Halted machine goes on from pc
+    if err := p.SetPc(0); err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, p, 100)
+    if mem := p.GetMem(); mem[0] != 1 {
+        t.Errorf("MEM[0] = %d after SetPc on halted machine, want 1", mem[0])
+    }
+}
+
+func TestStateIsCopy(t *testing.T) {
+    p := NewPennywise700()
+    s := p.State()
+    p.SetReg(2, 5)
+    p.SetMemCell(3, 6)
+    if s.RF[2] != 0 || s.Mem[3] != 0 {
+        t.Errorf("snapshot changed with machine: r2 %d, mem[3] %d", s.RF[2], s.Mem[3])
+    }
+    if len(s.Stages) != 5 || s.Stages[isa.WriteBack].Name != "Write Back" {
+        t.Errorf("stages of snapshot: %v", s.Stages)
+    }
+}
+
+func TestMultiCycleExecute(t *testing.T) {
+    prog := []uint32{
+        encode("LTM", 7, 0),
+        encode("LTM", 3, 1),
+        encode("MTR", 2, 0),
+        encode("MTR", 3, 1),
+        encode("MUL", 2, 3, 4),
+        encode("DIV", 2, 3, 5),
+        encode("MOD", 2, 3, 6),
+        encode("HALT"),
+    }
+    cycles := make([]uint64, 0)
+    for _, latency := range []int{1, 5} {
+        p := NewPennywise700()
+        p.MulCycles, p.DivCycles = latency, latency
+        if err := p.LoadProgram(prog); err != nil {
+            t.Fatal(err)
+        }
+        runUntilHalt(t, p, 1000)
+        if p.RF[4] != 21 || p.RF[5] != 2 || p.RF[6] != 1 {
+            t.Errorf("latency %d: r4, r5, r6 = %d, %d, %d, want 21, 2, 1", latency, p.RF[4], p.RF[5], p.RF[6])
+        }
+        cycles = append(cycles, p.GetStats().Cycles)
+    }
+    //Every command holds Execute 4 more cycles
+    if cycles[1] != cycles[0] + 3*4 {
+        t.Errorf("cycles with latency 1 and 5: %v, want difference of 12", cycles)
+    }
+}
+
+func TestDivideByZero(t *testing.T) {
+    p := NewPennywise700()
+    err := p.LoadProgram([]uint32{
+        encode("LTM", 5, 0),
+        encode("DIV", 1, 2, 3),
+        encode("LTM", 6, 1),
+        encode("HALT"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for range 100 {
+        p.EmulateCycle()
+    }
+    if !errors.Is(p.Fault(), ErrDivideByZero) {
+        t.Fatalf("fault = %v, want %v", p.Fault(), ErrDivideByZero)
+    }
+    if mem := p.GetMem(); mem[0] != 5 || mem[1] != 0 {
+        t.Errorf("MEM[0:2] = %v, want older command done and younger one not", mem[0:2])
+    }
+}
+
+func TestConditionalJumps(t *testing.T) {
+    const minusOne = 0xFFFF
+    tests := []struct {
+        mnemonic string
+        r2, r3   uint16
+        taken    bool
+    }{
+        {"JUMP_LESS", 5, 3, true},
+        {"JGEU", 3, 3, true},
+        {"JGEU", minusOne, 5, true},
+        {"JLTU", minusOne, 5, false},
+        {"JLTU", 3, 5, true},
+        {"JEQ", 4, 4, true},
+        {"JEQ", 4, 5, false},
+        {"JNE", 4, 5, true},
+        {"JNE", 5, 5, false},
+        {"JGE", minusOne, 5, false},
+        {"JGE", 5, minusOne, true},
+        {"JLT", minusOne, 5, true},
+        {"JLT", 5, 5, false},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        err := p.LoadProgram([]uint32{
+            encode(test.mnemonic, 2, 3, 3),
+            encode("LTM", 1, 0),
+            encode("HALT"),
+            encode("LTM", 2, 0),
+            encode("HALT"),
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        p.SetReg(2, test.r2)
+        p.SetReg(3, test.r3)
+        runUntilHalt(t, p, 100)
+        if taken := p.GetMem()[0] == 2; taken != test.taken {
+            t.Errorf("%v with r2 = %d, r3 = %d: taken %v, want %v", test.mnemonic, test.r2, test.r3, taken, test.taken)
+        }
+    }
+}
+
+func TestCallRet(t *testing.T) {
+    p := NewPennywise700()
+    //r2 = 3 * r2 in subroutine at 6, which keeps r3
+    err := p.LoadProgram([]uint32{
+        encode("LTR", 2, 3),
+        encode("CALL", 6),
+        encode("RTMK", 0, 2),
+        encode("LTR", 2, 7),
+        encode("CALL", 6),
+        encode("HALT"),
+        encode("PUSH", 3),
+        encode("RTR", 3, 2),
+        encode("SUM", 2, 3, 2),
+        encode("SUM", 2, 3, 2),
+        encode("POP", 3),
+        encode("RET"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    p.SetReg(3, 42)
+    runUntilHalt(t, p, 1000)
+    if p.Fault() != nil {
+        t.Fatal(p.Fault())
+    }
+    if mem := p.GetMem(); mem[0] != 9 || p.RF[2] != 21 || p.RF[3] != 42 {
+        t.Errorf("MEM[0] = %d, r2 = %d, r3 = %d, want 9, 21, 42", mem[0], p.RF[2], p.RF[3])
+    }
+    if p.RF[isa.SP] != IOBase {
+        t.Errorf("SP = %d after returns, want %d", p.RF[isa.SP], IOBase)
+    }
+}
+
+func TestStackFaults(t *testing.T) {
+    tests := []struct {
+        cmd  uint32
+        sp   uint16
+        want error
+    }{
+        {encode("POP", 2), IOBase, ErrStackUnderflow},
+        {encode("RET"), IOBase, ErrStackUnderflow},
+        {encode("PUSH", 2), 0, ErrStackOverflow},
+        {encode("CALL", 0), 0, ErrStackOverflow},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        if err := p.LoadProgram([]uint32{test.cmd, encode("HALT")}); err != nil {
+            t.Fatal(err)
+        }
+        p.SetReg(isa.SP, test.sp)
+        for range 100 {
+            p.EmulateCycle()
+        }
+        if !errors.Is(p.Fault(), test.want) {
+            t.Errorf("%v with SP %d: fault %v, want %v", isa.Disassemble(test.cmd), test.sp, p.Fault(), test.want)
+        }
+    }
+}
+
+func TestJumpRegister(t *testing.T) {
+    p := NewPennywise700()
+    //Address is computed right before JR, so it's forwarded or stalled for
+    err := p.LoadProgram([]uint32{
+        encode("LTR", 2, 2),
+        encode("ADDI", 2, 3),
+        encode("JR", 2),
+        encode("LTM", 1, 0),
+        encode("HALT"),
+        encode("LTM", 2, 0),
+        encode("HALT"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, p, 100)
+    if mem := p.GetMem(); mem[0] != 2 {
+        t.Errorf("MEM[0] = %d, want 2 from command at 5", mem[0])
+    }
+}
+
+func TestFlags(t *testing.T) {
+    tests := []struct {
+        mnemonic string
+        r2, r3   uint16
+        flags    uint16
+    }{
+        {"SUM", 0xFFFF, 1, isa.FlagZ | isa.FlagC},
+        {"SUM", 0x7FFF, 1, isa.FlagV | isa.FlagN},
+        {"SUB", 1, 2, isa.FlagC | isa.FlagN},
+        {"SUB", 0x8000, 1, isa.FlagV},
+        {"SUB", 5, 5, isa.FlagZ},
+        {"AND", 0xF0, 0x0F, isa.FlagZ},
+        {"XOR", 0x8000, 1, isa.FlagN},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        if err := p.LoadProgram([]uint32{encode(test.mnemonic, 2, 3, 4), encode("HALT")}); err != nil {
+            t.Fatal(err)
+        }
+        p.SetReg(2, test.r2)
+        p.SetReg(3, test.r3)
+        runUntilHalt(t, p, 100)
+        if p.GetFlags() != test.flags {
+            t.Errorf("%v %#x, %#x: flags %04b, want %04b", test.mnemonic, test.r2, test.r3, p.GetFlags(), test.flags)
+        }
+    }
+}
+
+func TestLogic(t *testing.T) {
+    tests := []struct {
+        mnemonic string
+        //NOT takes only r2
+        r2, r3   uint16
+        res      uint16
+        flags    uint16
+    }{
+        {"AND", 0xF0F0, 0xFF00, 0xF000, isa.FlagN},
+        {"AND", 0x0F0F, 0x00FF, 0x000F, 0},
+        {"AND", 0xF0, 0x0F, 0, isa.FlagZ},
+        {"OR", 0xF000, 0x000F, 0xF00F, isa.FlagN},
+        {"OR", 0x0F00, 0x00F0, 0x0FF0, 0},
+        {"OR", 0, 0, 0, isa.FlagZ},
+        {"XOR", 0xFF00, 0x0FF0, 0xF0F0, isa.FlagN},
+        {"XOR", 0x1234, 0x1230, 0x0004, 0},
+        {"XOR", 0xABCD, 0xABCD, 0, isa.FlagZ},
+        {"NOT", 0x00FF, 0, 0xFF00, isa.FlagN},
+        {"NOT", 0xF00F, 0, 0x0FF0, 0},
+        {"NOT", 0xFFFF, 0, 0, isa.FlagZ},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        cmd := encode(test.mnemonic, 2, 3, 4)
+        if test.mnemonic == "NOT" {
+            cmd = encode("NOT", 4, 2)
+        }
+        if err := p.LoadProgram([]uint32{cmd, encode("HALT")}); err != nil {
+            t.Fatal(err)
+        }
+        //Carry and overflow left by previous command are cleared
+        p.flags = isa.FlagC | isa.FlagV
+        p.SetReg(2, test.r2)
+        p.SetReg(3, test.r3)
+        runUntilHalt(t, p, 100)
+        if p.RF[4] != test.res || p.GetFlags() != test.flags {
+            t.Errorf("%v %#x, %#x: %#x with flags %04b, want %#x with %04b", test.mnemonic, test.r2, test.r3, p.RF[4], p.GetFlags(), test.res, test.flags)
+        }
+    }
+}
+
+func TestShifts(t *testing.T) {
+    const n, c, z = isa.FlagN, isa.FlagC, isa.FlagZ
+    tests := []struct {
+        mnemonic string
+        val      uint16
+        //Amount is in register, or in shamt field for commands with I
+        amount   uint16
+        res      uint16
+        flags    uint16
+    }{
+        {"SHL", 0x8001, 0, 0x8001, n},
+        {"SHL", 0x8001, 1, 0x0002, c},
+        {"SHL", 0x0003, 15, 0x8000, n | c},
+        {"SHL", 0xFFFF, 16, 0, z | c},
+        {"SHL", 0xFFFF, 17, 0, z},
+        {"SHLI", 0x0001, 15, 0x8000, n},
+        {"SHR", 0x8001, 0, 0x8001, n},
+        {"SHR", 0x8001, 1, 0x4000, c},
+        {"SHR", 0xC000, 15, 0x0001, c},
+        {"SHR", 0x8000, 16, 0, z | c},
+        {"SHR", 0xFFFF, 20, 0, z},
+        {"SHRI", 0x8000, 15, 0x0001, 0},
+        //Sign bit fills the vacated bits
+        {"SAR", 0x8000, 0, 0x8000, n},
+        {"SAR", 0x8001, 1, 0xC000, n | c},
+        {"SAR", 0x8000, 15, 0xFFFF, n},
+        {"SAR", 0x8000, 16, 0xFFFF, n | c},
+        {"SAR", 0x8000, 20, 0xFFFF, n | c},
+        {"SAR", 0x7FFF, 16, 0, z},
+        {"SARI", 0x4000, 1, 0x2000, 0},
+        {"ROL", 0x8001, 0, 0x8001, n},
+        {"ROL", 0x8001, 1, 0x0003, c},
+        {"ROL", 0x8001, 15, 0xC000, n},
+        {"ROL", 0x8001, 16, 0x8001, n | c},
+        {"ROL", 0x8001, 17, 0x0003, c},
+        {"ROLI", 0x0001, 15, 0x8000, n},
+        {"ROR", 0x8001, 0, 0x8001, n},
+        {"ROR", 0x8001, 1, 0xC000, n | c},
+        {"ROR", 0x0001, 15, 0x0002, 0},
+        {"ROR", 0x8001, 16, 0x8001, n | c},
+        {"ROR", 0x0001, 17, 0x8000, n | c},
+        {"RORI", 0x0002, 1, 0x0001, 0},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        cmd := encode(test.mnemonic, 2, 3, 4)
+        if strings.HasSuffix(test.mnemonic, "I") {
+            cmd = encode(test.mnemonic, 2, test.amount, 4)
+        }
+        if err := p.LoadProgram([]uint32{cmd, encode("HALT")}); err != nil {
+            t.Fatal(err)
+        }
+        p.SetReg(2, test.val)
+        p.SetReg(3, test.amount)
+        runUntilHalt(t, p, 100)
+        if p.RF[4] != test.res || p.GetFlags() != test.flags {
+            t.Errorf("%v %#x, %d: %#x with flags %04b, want %#x with %04b", test.mnemonic, test.val, test.amount, p.RF[4], p.GetFlags(), test.res, test.flags)
+        }
+    }
+}
+
+func TestFlagsForwarding(t *testing.T) {
+    p := NewPennywise700()
+    //Two words numbers 0x0001_FFFF + 0x0000_0001 in r3:r2 and r5:r4, sum goes to r7:r6
+    //Flags are needed by the command right after the one setting them
+    err := p.LoadProgram([]uint32{
+        encode("SUM", 2, 4, 6),
+        encode("ADC", 3, 5, 7),
+        encode("SUB", 7, 7, 8),
+        encode("JZ", 5),
+        encode("HALT"),
+        encode("LTM", 1, 0),
+        encode("HALT"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    p.SetReg(2, 0xFFFF)
+    p.SetReg(3, 1)
+    p.SetReg(4, 1)
+    p.SetReg(5, 0)
+    runUntilHalt(t, p, 100)
+    if p.RF[6] != 0 || p.RF[7] != 2 {
+        t.Errorf("r7:r6 = %#x:%#x, want 0x2:0x0", p.RF[7], p.RF[6])
+    }
+    if mem := p.GetMem(); mem[0] != 1 {
+        t.Error("JZ right after SUB giving zero isn't taken")
+    }
+    if p.GetStats().Stalls[isa.StageNames[isa.Decode2]][stats.HazardFlags] == 0 {
+        t.Error("no stalls for flags")
+    }
+}
+
+func TestConsole(t *testing.T) {
+    p := NewPennywise700()
+    var out bytes.Buffer
+    p.Console = &out
+    //Number is written by RTMK with address in register, characters by LTM
+    err := p.LoadProgram([]uint32{
+        encode("LTM", 'o', PortChar),
+        encode("LTM", 'k', PortChar),
+        encode("LTM", '\n', PortChar),
+        encode("LTR", 2, PortNum),
+        encode("LTR", 3, 700),
+        encode("RTMK", 2, 3),
+        encode("HALT"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, p, 100)
+    if out.String() != "ok\n700\n" {
+        t.Errorf("console output %q, want %q", out.String(), "ok\n700\n")
+    }
+    if mem := p.GetMem(); mem[PortChar] != 0 || mem[PortNum] != 0 {
+        t.Errorf("ports are written to memory: %v", mem[IOBase:])
+    }
+}
+
+func TestInput(t *testing.T) {
+    //Sum of numbers until the end of input, MTR after the jump is dropped and doesn't take a number
+    prog := []uint32{
+        encode("LTR", 5, PortIn),
+        encode("LTR", 6, 0),
+        encode("NOT", 6, 6),
+        encode("MTRK", 2, 5),
+        encode("JEQ", 2, 6, 7),
+        encode("SUM", 2, 3, 3),
+        encode("JMP", 3),
+        encode("MTR", 4, PortIn),
+        encode("HALT"),
+    }
+    tests := []struct {
+        in    string
+        sum   uint16
+        after uint16
+    }{
+        {"1 2\n3\n\n4", 10, InputEOF},
+        {"", 0, InputEOF},
+        {"7 -2 2", 7, InputEOF},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        if err := p.LoadProgram(prog); err != nil {
+            t.Fatal(err)
+        }
+        p.SetInput(strings.NewReader(test.in))
+        runUntilHalt(t, p, 1000)
+        if p.Fault() != nil {
+            t.Fatal(p.Fault())
+        }
+        if p.RF[3] != test.sum || p.RF[4] != test.after {
+            t.Errorf("input %q: sum %d, then %#x, want %d, then %#x", test.in, p.RF[3], p.RF[4], test.sum, test.after)
+        }
+    }
+
+    //-1 and 65535 are the same word as InputEOF, so they aren't allowed
+    for _, in := range []string{"5 five", "5 -1", "5 65535", "5 70000"} {
+        p := NewPennywise700()
+        if err := p.LoadProgram(prog); err != nil {
+            t.Fatal(err)
+        }
+        p.SetInput(strings.NewReader(in))
+        for range 1000 {
+            p.EmulateCycle()
+        }
+        if !errors.Is(p.Fault(), ErrInput) || p.RF[3] != 5 {
+            t.Errorf("input %q: fault %v, sum %d, want %v after 5", in, p.Fault(), p.RF[3], ErrInput)
+        }
+    }
+}
+
+func TestExceptions(t *testing.T) {
+    illegal := uint32(isa.Ext) << 20 | 0xFF
+    if isa.Decode(illegal) != nil {
+        t.Fatalf("%#x is a known command", illegal)
+    }
+    tests := []struct {
+        name string
+        prog []uint32
+        pc   uint16
+        want error
+    }{
+        {"illegal command", []uint32{encode("LTM", 7, 0), illegal, encode("LTM", 8, 1), encode("HALT")}, 1, ErrIllegalCommand},
+        {"MTRK out of memory", []uint32{
+            encode("LTR", 2, 1023), encode("ADDI", 2, 1), encode("LTM", 7, 0),
+            encode("MTRK", 3, 2), encode("LTM", 8, 1), encode("HALT"),
+        }, 3, ErrBadAddress},
+        {"RTMK out of memory", []uint32{
+            encode("LTR", 2, 1023), encode("ADDI", 2, 1), encode("LTM", 7, 0),
+            encode("RTMK", 2, 3), encode("LTM", 8, 1), encode("HALT"),
+        }, 3, ErrBadAddress},
+        {"jump past command memory", []uint32{
+            encode("LTR", 2, 1023), encode("ADDI", 2, 1), encode("LTM", 7, 0), encode("JR", 2), encode("LTM", 8, 1),
+        }, 1024, ErrPcOverflow},
+    }
+    for _, test := range tests {
+        p := NewPennywise700()
+        if err := p.LoadProgram(test.prog); err != nil {
+            t.Fatal(err)
+        }
+        for range 100 {
+            p.EmulateCycle()
+        }
+        var e *Exception
+        if !errors.As(p.Fault(), &e) || !errors.Is(e, test.want) {
+            t.Errorf("%v: fault %v, want %v", test.name, p.Fault(), test.want)
+            continue
+        }
+        if e.Pc != test.pc || e.Cmd != p.fetch(test.pc) {
+            t.Errorf("%v: exception at %d with %#x, want %d with %#x", test.name, e.Pc, e.Cmd, test.pc, p.fetch(test.pc))
+        }
+        //Older commands are done and younger ones are not
+        if mem := p.GetMem(); mem[0] != 7 || mem[1] != 0 {
+            t.Errorf("%v: MEM[0:2] = %v, want [7 0]", test.name, mem[0:2])
+        }
+    }
+}
+
+func TestExceptionHandler(t *testing.T) {
+    p := NewPennywise700()
+    //Handler at 4 skips the faulting command
+    err := p.LoadProgram([]uint32{
+        encode("LTM", 7, 0),
+        uint32(isa.Ext) << 20 | 0xFF,
+        encode("LTM", 8, 1),
+        encode("HALT"),
+        encode("POP", 2),
+        encode("ADDI", 2, 1),
+        encode("PUSH", 2),
+        encode("MTR", 4, PortCause),
+        encode("RET"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := p.SetHandler(4); err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, p, 200)
+    if p.Fault() != nil {
+        t.Fatal(p.Fault())
+    }
+    if mem := p.GetMem(); mem[0] != 7 || mem[1] != 8 {
+        t.Errorf("MEM[0:2] = %v, want [7 8]", mem[0:2])
+    }
+    if e := p.LastException(); e == nil || !errors.Is(e, ErrIllegalCommand) || e.Pc != 1 {
+        t.Errorf("last exception %v, want %v at 1", e, ErrIllegalCommand)
+    }
+    if want := uint16(slices.Index(Causes, ErrIllegalCommand) + 1); p.RF[4] != want {
+        t.Errorf("cause code %d, want %d", p.RF[4], want)
+    }
+    if p.RF[isa.SP] != IOBase {
+        t.Errorf("SP = %d after handler, want %d", p.RF[isa.SP], IOBase)
+    }
+}
+
+func TestConfig(t *testing.T) {
+    if _, err := New(isa.Config{Mem: 1024, Cmd: 1024, Regs: 64}); err == nil {
+        t.Error("machine of 64 registers is made")
+    }
+
+    //Addresses above 1024 get wider fields
+    big, err := New(isa.Config{Mem: 4096, Cmd: 2048, Regs: 32})
+    if err != nil {
+        t.Fatal(err)
+    }
+    set := big.ISA()
+    encode := func(mnemonic string, ops ...uint16) uint32 {
+        return set.ByMnemonic(mnemonic).Encode(ops)
+    }
+    err = big.LoadProgram([]uint32{
+        encode("LTM", 7, 3000),
+        encode("MTR", 20, 3000),
+        encode("LTR", 21, 4000),
+        encode("RTMK", 21, 20),
+        encode("JMP", 2000),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for range 100 {
+        big.EmulateCycle()
+    }
+    if mem := big.GetMem(); mem[3000] != 7 || mem[4000] != 7 || big.RF[20] != 7 {
+        t.Errorf("MEM[3000] = %d, MEM[4000] = %d, r20 = %d, want 7", mem[3000], mem[4000], big.RF[20])
+    }
+    if !errors.Is(big.Fault(), ErrPcOverflow) || big.LastException().Pc != 2048 {
+        t.Errorf("fault %v, want %v at 2048", big.Fault(), ErrPcOverflow)
+    }
+    if sp := big.RF[set.SP]; set.SP != 31 || sp != big.Port(IOBase) || sp != 4092 {
+        t.Errorf("r%d = %d is stack pointer, want r31 = 4092", set.SP, sp)
+    }
+
+    //Small machine keeps default encoding, but operands are checked against its sizes
+    small, err := New(isa.Config{Mem: 16, Cmd: 16, Regs: 4})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, cmd := range []uint32{isa.ByMnemonic("RTR").Encode([]uint16{4, 0}), isa.ByMnemonic("LTM").Encode([]uint16{0, 16})} {
+        if err := small.LoadProgram([]uint32{cmd}); err == nil {
+            t.Errorf("%v is loaded to machine of 4 registers and 16 cells", isa.Disassemble(cmd))
+        }
+    }
+    if err := small.LoadProgram(make([]uint32, 17)); err == nil {
+        t.Error("17 commands are loaded to command memory of 16 cells")
+    }
+    if err := small.LoadProgram([]uint32{isa.ByMnemonic("PUSH").Encode([]uint16{1}), isa.ByMnemonic("HALT").Encode(nil)}); err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, small, 100)
+    if mem := small.GetMem(); small.RF[3] != 11 || mem[11] != 1 {
+        t.Errorf("SP r3 = %d, MEM[11] = %d after push, want 11 and 1", small.RF[3], mem[11])
+    }
+}
+
+func TestLoadFileConfig(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "prog.txt")
+    write := func(c isa.Config) {
+        var prog strings.Builder
+        if err := isa.WriteProgramConfig(&prog, []uint32{isa.ByMnemonic("HALT").Encode(nil)}, c); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(prog.String()), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    tests := []struct {
+        prog isa.Config
+        ok   bool
+    }{
+        {isa.DefaultConfig, true},
+        {isa.Config{Mem: 16, Cmd: 16, Regs: 4}, true},
+        {isa.Config{Mem: 1024, Cmd: 1024, Regs: 32}, false},
+        {isa.Config{Mem: 4096, Cmd: 1024, Regs: 16}, false},
+    }
+    for _, test := range tests {
+        write(test.prog)
+        p := NewPennywise700()
+        if err := p.LoadFile(path); (err == nil) != test.ok {
+            t.Errorf("program for %v: error %v", test.prog, err)
+        }
+    }
+}
+
+func TestForwarding(t *testing.T) {
+    //Every command needs the result of the one before it
+    chain := []uint32{
+        encode("LTR", 2, 1),
+        encode("SUM", 2, 2, 3),
+        encode("SUM", 3, 3, 4),
+        encode("PUSH", 4),
+        encode("POP", 5),
+        encode("SUB", 5, 2, 6),
+        encode("RTMK", 1, 6),
+        encode("HALT"),
+    }
+    for _, test := range []struct {
+        name string
+        prog []uint32
+        mem  []uint16
+    }{
+        {"chain", chain, []uint16{0, 3}},
+        {"insertion sort", insertionSort(t), []uint16{4, 5, 7, 3}},
+    } {
+        cycles := make(map[Forwarding]uint64)
+        for _, f := range []Forwarding{ForwardNone, ForwardWB, ForwardEX, ForwardFull} {
+            p := NewPennywise700()
+            p.Forwarding = f
+            if err := p.LoadProgram(test.prog); err != nil {
+                t.Fatal(err)
+            }
+            runUntilHalt(t, p, 2000)
+            if mem := p.GetMem(); !slices.Equal(mem[:len(test.mem)], test.mem) {
+                t.Errorf("%v with forwarding %v: MEM = %v, want %v", test.name, f, mem[:len(test.mem)], test.mem)
+            }
+            forwards := p.GetStats().Forwards
+            if (forwards[isa.StageNames[isa.WriteBack]] > 0) != (f&ForwardWB != 0) || (forwards[isa.StageNames[isa.Execute]] > 0) != (f&ForwardEX != 0) {
+                t.Errorf("%v with forwarding %v: forwards %v", test.name, f, forwards)
+            }
+            cycles[f] = p.GetStats().Cycles
+        }
+        if !(cycles[ForwardNone] > cycles[ForwardWB] && cycles[ForwardWB] > cycles[ForwardFull] && cycles[ForwardEX] > cycles[ForwardFull]) {
+            t.Errorf("%v: cycles %v, want less with every path added", test.name, cycles)
+        }
+    }
+}
+
+//Stage held by stall reads operands again, forward is counted once the command moves on
+func TestForwardingHeld(t *testing.T) {
+    for _, test := range []struct {
+        name     string
+        prog     []uint32
+        forwards uint64
+    }{
+        //SUM reads r2 on Decode 2 while LTR is on write back
+        {"moves on", []uint32{encode("LTR", 2, 5), encode("NOP"), encode("SUM", 1, 2, 4), encode("HALT")}, 1},
+        //SUM waits on Decode 2 for MUL, r2 is written by then
+        {"held behind MUL", []uint32{encode("LTR", 2, 5), encode("MUL", 1, 1, 3), encode("SUM", 1, 2, 4), encode("HALT")}, 0},
+        //SUB waits on Decode 1 for r3 of MUL and takes it from write back when MUL is done
+        {"held for operand", []uint32{encode("MUL", 1, 1, 3), encode("SUB", 3, 1, 4), encode("HALT")}, 1},
+    } {
+        p := NewPennywise700()
+        if err := p.LoadProgram(test.prog); err != nil {
+            t.Fatal(err)
+        }
+        runUntilHalt(t, p, 100)
+        forwards := p.GetStats().Forwards[isa.StageNames[isa.WriteBack]]
+        if forwards != test.forwards {
+            t.Errorf("%v: %d forwards, want %d", test.name, forwards, test.forwards)
+        }
+    }
+}
+
+func TestPredictors(t *testing.T) {
+    //Sum of 10..1 with backward loop
+    loop := []uint32{
+        encode("LTR", 2, 10),
+        encode("LTR", 3, 0),
+        encode("SUM", 3, 2, 3),
+        encode("SUB", 2, 1, 2),
+        encode("JNE", 2, 0, 2),
+        encode("RTMK", 0, 3),
+        encode("HALT"),
+    }
+    //Sum of 5..1 by subroutine, RET goes to the same place every time
+    call := []uint32{
+        encode("LTR", 2, 5),
+        encode("LTR", 3, 0),
+        encode("CALL", 7),
+        encode("SUB", 2, 1, 2),
+        encode("JNE", 2, 0, 2),
+        encode("RTMK", 0, 3),
+        encode("HALT"),
+        encode("SUM", 3, 2, 3),
+        encode("RET"),
+    }
+    for _, test := range []struct {
+        name string
+        prog []uint32
+        mem  []uint16
+    }{
+        {"loop", loop, []uint16{55}},
+        {"call", call, []uint16{15}},
+        {"insertion sort", insertionSort(t), []uint16{4, 5, 7, 3}},
+    } {
+        runs := make(map[string]*stats.Counters)
+        for _, name := range predict.Names {
+            p := NewPennywise700()
+            predictor, err := predict.Parse(name)
+            if err != nil {
+                t.Fatal(err)
+            }
+            p.Predictor = predictor
+            if err := p.LoadProgram(test.prog); err != nil {
+                t.Fatal(err)
+            }
+            runUntilHalt(t, p, 2000)
+            if mem := p.GetMem(); !slices.Equal(mem[:len(test.mem)], test.mem) {
+                t.Errorf("%v with %v: MEM = %v, want %v", test.name, name, mem[:len(test.mem)], test.mem)
+            }
+            if p.RF[isa.SP] != IOBase {
+                t.Errorf("%v with %v: SP = %d, want %d", test.name, name, p.RF[isa.SP], IOBase)
+            }
+            runs[name] = p.GetStats()
+        }
+        never := runs["not-taken"]
+        if never.Mispredicts != never.TakenBranches {
+            t.Errorf("%v: not-taken mispredicts %d of %d taken branches", test.name, never.Mispredicts, never.TakenBranches)
+        }
+        for name, c := range runs {
+            if c.Branches != never.Branches || c.TakenBranches != never.TakenBranches {
+                t.Errorf("%v with %v: %d branches, %d taken, want %d, %d", test.name, name, c.Branches, c.TakenBranches, never.Branches, never.TakenBranches)
+            }
+            if c.Mispredicts > never.Mispredicts || c.Cycles > never.Cycles {
+                t.Errorf("%v with %v: %d mispredicts in %d cycles, not-taken has %d in %d", test.name, name, c.Mispredicts, c.Cycles, never.Mispredicts, never.Cycles)
+            }
+        }
+        if runs["2bit"].Accuracy() <= never.Accuracy() {
+            t.Errorf("%v: 2bit accuracy %.2f, not-taken %.2f", test.name, runs["2bit"].Accuracy(), never.Accuracy())
+        }
+    }
+}
+
+func TestBTBPredictsReturn(t *testing.T) {
+    b := predict.Branch{Pc: 8, Always: true}
+    btb := predict.NewBTB(predict.BTBSize)
+    if taken, _ := btb.Predict(b); taken {
+        t.Fatal("empty BTB predicts RET taken")
+    }
+    btb.Update(b, true, 3)
+    if taken, target := btb.Predict(b); !taken || target != 3 {
+        t.Errorf("BTB predicts %v to %d, want taken to 3", taken, target)
+    }
+    //Another branch with the same low bits takes the entry
+    other := predict.Branch{Pc: 8 + predict.BTBSize, Always: true}
+    btb.Update(other, true, 40)
+    if taken, _ := btb.Predict(b); taken {
+        t.Error("BTB predicts evicted branch taken")
+    }
+}
+
+func TestEarlyResolution(t *testing.T) {
+    for _, test := range []struct {
+        name string
+        prog []uint32
+        mem  []uint16
+    }{
+        {"jump over", []uint32{
+            encode("JMP", 2),
+            encode("LTM", 9, 0),
+            encode("LTM", 1, 0),
+            encode("HALT"),
+        }, []uint16{1}},
+        //Compared register is written by the command right before the jump
+        {"loop", []uint32{
+            encode("LTR", 2, 10),
+            encode("LTR", 3, 0),
+            encode("SUM", 3, 2, 3),
+            encode("SUB", 2, 1, 2),
+            encode("JNE", 2, 0, 2),
+            encode("RTMK", 0, 3),
+            encode("HALT"),
+        }, []uint16{55}},
+        //Conditional jump on Execute is on the wrong path of JR on write back
+        {"older jump wins", []uint32{
+            encode("LTR", 4, 3),
+            encode("JR", 4),
+            encode("JEQ", 0, 0, 5),
+            encode("LTM", 7, 0),
+            encode("HALT"),
+            encode("LTM", 9, 0),
+            encode("HALT"),
+        }, []uint16{7}},
+        {"insertion sort", insertionSort(t), []uint16{4, 5, 7, 3}},
+    } {
+        for _, f := range []Forwarding{ForwardNone, ForwardWB, ForwardFull} {
+            for _, name := range predict.Names {
+                runs := make(map[Resolution]*stats.Counters)
+                for _, r := range []Resolution{ResolveWB, ResolveEarly} {
+                    p := NewPennywise700()
+                    p.Forwarding, p.Resolution = f, r
+                    predictor, err := predict.Parse(name)
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                    p.Predictor = predictor
+                    if err := p.LoadProgram(test.prog); err != nil {
+                        t.Fatal(err)
+                    }
+                    runUntilHalt(t, p, 2000)
+                    if mem := p.GetMem(); !slices.Equal(mem[:len(test.mem)], test.mem) {
+                        t.Errorf("%v with forwarding %v, %v, resolution %v: MEM = %v, want %v", test.name, f, name, r, mem[:len(test.mem)], test.mem)
+                    }
+                    runs[r] = p.GetStats()
+                }
+                wb, early := runs[ResolveWB], runs[ResolveEarly]
+                if early.Branches != wb.Branches || early.Mispredicts != wb.Mispredicts {
+                    t.Errorf("%v with forwarding %v, %v: early resolves %d branches with %d mispredicts, want %d with %d",
+                        test.name, f, name, early.Branches, early.Mispredicts, wb.Branches, wb.Mispredicts)
+                }
+                if early.Cycles > wb.Cycles || early.FlushedSlots > wb.FlushedSlots {
+                    t.Errorf("%v with forwarding %v, %v: early takes %d cycles and flushes %d slots, write back %d and %d",
+                        test.name, f, name, early.Cycles, early.FlushedSlots, wb.Cycles, wb.FlushedSlots)
+                }
+            }
+        }
+    }
+
+    //JMP on Decode 1 drops only Fetch
+    p := NewPennywise700()
+    p.Resolution = ResolveEarly
+    if err := p.LoadProgram([]uint32{encode("JMP", 2), encode("LTM", 9, 0), encode("HALT")}); err != nil {
+        t.Fatal(err)
+    }
+    runUntilHalt(t, p, 100)
+    if c := p.GetStats(); c.FlushedSlots != 1 || c.Cycles != 7 {
+        t.Errorf("JMP on Decode 1: %d flushed slots in %d cycles, want 1 in 7", c.FlushedSlots, c.Cycles)
+    }
+
+    //Exception on Execute drops the younger JMP on Decode 1
+    p = NewPennywise700()
+    p.Resolution, p.DivCycles = ResolveEarly, 1
+    err := p.LoadProgram([]uint32{
+        encode("DIV", 1, 0, 2),
+        encode("NOP"),
+        encode("JMP", 4),
+        encode("LTM", 5, 0),
+        encode("HALT"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for range 20 {
+        p.EmulateCycle()
+    }
+    if !errors.Is(p.Fault(), ErrDivideByZero) || p.LastException().Pc != 0 || p.GetStats().Branches != 0 {
+        t.Errorf("fault %v with %d branches resolved, want divide by zero at 0 and none", p.Fault(), p.GetStats().Branches)
+    }
+}
+
+func TestSpeculative(t *testing.T) {
+    prog := []uint32{
+        encode("JNE", 1, 0, 3),
+        encode("LTM", 9, 0),
+        encode("LTM", 8, 0),
+        encode("HALT"),
+    }
+    for _, test := range []struct {
+        r Resolution
+        //Last cycle Fetch is on the path of JNE, it's resolved on write back or Execute on the next one
+        cycles int
+    }{
+        {ResolveWB, 3},
+        {ResolveEarly, 2},
+    } {
+        p := NewPennywise700()
+        p.Resolution = test.r
+        if err := p.LoadProgram(prog); err != nil {
+            t.Fatal(err)
+        }
+        for cycle := range 6 {
+            p.EmulateCycle()
+            if want := cycle >= 1 && cycle <= test.cycles; p.Speculative(isa.Fetch) != want {
+                t.Errorf("resolution %v, cycle %d: speculative fetch %v, want %v", test.r, cycle, !want, want)
+            }
+        }
+    }
+}
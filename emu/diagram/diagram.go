@@ -0,0 +1,159 @@
+// Pipeline diagram of emulated program
+// Every cycle is a row with commands on Fetch, Decode 1, Decode 2, Execute and Write Back,
+// like the tables in docs are written by hand
+package diagram
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+// Command on stage during one cycle
+type Cell struct {
+    Cmd     uint32
+    //False for bubbles and empty stages
+    Valid   bool
+    //Bubble put in pipe by stall
+    Stall   bool
+    //Operand is taken from write back, or write back gives it
+    Forward bool
+}
+
+type Row []Cell
+
+type Diagram struct {
+    Rows []Row
+    //Commands are shown as instruction set of machine gives them
+    ISA  *isa.ISA
+}
+
+func New(set *isa.ISA) *Diagram {
+    return &Diagram{Rows: make([]Row, 0), ISA: set}
+}
+
+func (d *Diagram) Add(row Row) {
+    d.Rows = append(d.Rows, row)
+}
+
+// Text of cell without marks, empty for bubbles
+func (c Cell) Text(set *isa.ISA) string {
+    switch {
+    case c.Stall:
+        return "stall"
+    case !c.Valid:
+        return ""
+    }
+    if text := set.Disassemble(c.Cmd); text != "" {
+        return text
+    }
+    return fmt.Sprintf("%0*b", set.Width, c.Cmd)
+}
+
+// Text of cell with forwarded command in bold and stall in italic
+func (c Cell) markdown(set *isa.ISA) string {
+    switch {
+    case c.Stall:
+        return "*" + c.Text(set) + "*"
+    case c.Forward && c.Valid:
+        return "**" + c.Text(set) + "**"
+    }
+    return c.Text(set)
+}
+
+func (c Cell) html(set *isa.ISA) string {
+    switch {
+    case c.Stall:
+        return "<i>" + html.EscapeString(c.Text(set)) + "</i>"
+    case c.Forward && c.Valid:
+        return "<b>" + html.EscapeString(c.Text(set)) + "</b>"
+    }
+    return html.EscapeString(c.Text(set))
+}
+
+const legend = "**BOLD** - Take data from write back\n\n*stall* - Bubble put by stall\n\n"
+
+func (d *Diagram) Markdown(w io.Writer) error {
+    widths := make([]int, len(isa.StageNames))
+    cells := make([][]string, len(d.Rows))
+    for i := range widths {
+        widths[i] = len(isa.StageNames[i])
+    }
+    for i, row := range d.Rows {
+        cells[i] = make([]string, len(row))
+        for j, c := range row {
+            cells[i][j] = c.markdown(d.ISA)
+            widths[j] = max(widths[j], len(cells[i][j]))
+        }
+    }
+    line := func(texts []string) string {
+        result := "|"
+        for i, t := range texts {
+            result += fmt.Sprintf(" %-*s |", widths[i], t)
+        }
+        return result + "\n"
+    }
+    dashes := make([]string, len(widths))
+    for i, width := range widths {
+        dashes[i] = strings.Repeat("-", width)
+    }
+
+    text := legend + line(isa.StageNames[:]) + line(dashes)
+    for _, row := range cells {
+        text += line(row)
+    }
+    _, err := io.WriteString(w, text)
+    return err
+}
+
+// Comma separated table, cells are marked the same way as in Markdown
+func (d *Diagram) CSV(w io.Writer) error {
+    out := csv.NewWriter(w)
+    out.Write(isa.StageNames[:])
+    for _, row := range d.Rows {
+        texts := make([]string, len(row))
+        for i, c := range row {
+            texts[i] = c.markdown(d.ISA)
+        }
+        out.Write(texts)
+    }
+    out.Flush()
+    return out.Error()
+}
+
+// Table to be put into a page, forwarded commands are in <b> and stalls in <i>
+func (d *Diagram) HTML(w io.Writer) error {
+    var text strings.Builder
+    text.WriteString("<table>\n<thead>\n<tr>")
+    for _, name := range isa.StageNames {
+        text.WriteString("<th>" + name + "</th>")
+    }
+    text.WriteString("</tr>\n</thead>\n<tbody>\n")
+    for _, row := range d.Rows {
+        text.WriteString("<tr>")
+        for _, c := range row {
+            text.WriteString("<td>" + c.html(d.ISA) + "</td>")
+        }
+        text.WriteString("</tr>\n")
+    }
+    text.WriteString("</tbody>\n</table>\n")
+    _, err := io.WriteString(w, text.String())
+    return err
+}
+
+// Writes diagram in format md, csv or html
+func (d *Diagram) Write(w io.Writer, format string) error {
+    switch format {
+    case "md":
+        return d.Markdown(w)
+    case "csv":
+        return d.CSV(w)
+    case "html":
+        return d.HTML(w)
+    }
+    return fmt.Errorf("Unknown diagram format %v, expected md, csv or html", format)
+}
@@ -0,0 +1,176 @@
+package diagram_test
+
+import (
+	"encoding/csv"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Tyulenb/Pennywise700/cpu"
+	"github.com/Tyulenb/Pennywise700/diagram"
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+func encode(mnemonic string, ops ...uint16) uint32 {
+    return isa.ByMnemonic(mnemonic).Encode(ops)
+}
+
+// SUB stalls for r3 written by LTR, and JMP flushes LTR 6, 1 and HALT fetched after it
+var program = []uint32{
+    encode("LTR", 3, 5),
+    encode("SUB", 3, 1, 4),
+    encode("JMP", 4),
+    encode("LTR", 6, 1),
+    encode("HALT"),
+}
+
+func record(t *testing.T, prog []uint32) *diagram.Diagram {
+    t.Helper()
+    p := cpu.NewPennywise700()
+    if err := p.LoadProgram(prog); err != nil {
+        t.Fatal(err)
+    }
+    p.RecordDiagram()
+    for range 100 {
+        if p.Halted() {
+            return p.GetDiagram()
+        }
+        p.EmulateCycle()
+    }
+    t.Fatal("no HALT in 100 cycles")
+    return nil
+}
+
+// Rows of cells checked in every format, cells are given as in Markdown
+var rows = map[int][]string{
+    //Bubble put by stall goes down the pipe
+    3: {"JMP 4", "SUB 3, 1, 4", "*stall*", "LTR 3, 5", ""},
+    4: {"JMP 4", "**SUB 3, 1, 4**", "*stall*", "*stall*", "**LTR 3, 5**"},
+    //JMP is on write back, commands fetched after it are dropped
+    8: {"", "", "HALT", "LTR 6, 1", "JMP 4"},
+    9: {"HALT", "", "", "", ""},
+}
+
+const cycles = 14
+
+func TestMarkdown(t *testing.T) {
+    var text strings.Builder
+    if err := record(t, program).Write(&text, "md"); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+    //Legend, header and dashes go before rows
+    table := lines[len(lines)-cycles-2:]
+    cells := func(line string) []string {
+        parts := strings.Split(strings.Trim(line, "|"), "|")
+        for i := range parts {
+            parts[i] = strings.TrimSpace(parts[i])
+        }
+        return parts
+    }
+    if got := cells(table[0]); !slices.Equal(got, isa.StageNames[:]) {
+        t.Errorf("header %q, want %q", got, isa.StageNames)
+    }
+    for i, want := range rows {
+        if got := cells(table[i+2]); !slices.Equal(got, want) {
+            t.Errorf("cycle %d: %q, want %q", i, got, want)
+        }
+    }
+}
+
+func TestCSV(t *testing.T) {
+    var text strings.Builder
+    if err := record(t, program).Write(&text, "csv"); err != nil {
+        t.Fatal(err)
+    }
+    records, err := csv.NewReader(strings.NewReader(text.String())).ReadAll()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != cycles+1 {
+        t.Fatalf("%d records, want %d", len(records), cycles+1)
+    }
+    if !slices.Equal(records[0], isa.StageNames[:]) {
+        t.Errorf("header %q, want %q", records[0], isa.StageNames)
+    }
+    for i, want := range rows {
+        if !slices.Equal(records[i+1], want) {
+            t.Errorf("cycle %d: %q, want %q", i, records[i+1], want)
+        }
+    }
+}
+
+func TestHTML(t *testing.T) {
+    d := record(t, program)
+    var text strings.Builder
+    if err := d.Write(&text, "html"); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(text.String(), "\n")
+    want := map[int]string{
+        3: "<tr><td>JMP 4</td><td>SUB 3, 1, 4</td><td><i>stall</i></td><td>LTR 3, 5</td><td></td></tr>",
+        4: "<tr><td>JMP 4</td><td><b>SUB 3, 1, 4</b></td><td><i>stall</i></td><td><i>stall</i></td><td><b>LTR 3, 5</b></td></tr>",
+        8: "<tr><td></td><td></td><td>HALT</td><td>LTR 6, 1</td><td>JMP 4</td></tr>",
+        9: "<tr><td>HALT</td><td></td><td></td><td></td><td></td></tr>",
+    }
+    //Table, head, header and body go before rows
+    for i, row := range want {
+        if lines[i+5] != row {
+            t.Errorf("cycle %d: %q, want %q", i, lines[i+5], row)
+        }
+    }
+
+    //Text of commands is escaped, mnemonic of SUB is changed to have special characters
+    set, err := isa.New(isa.DefaultConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+    set.ByMnemonic("SUB").Mnemonic = "<SUB&>"
+    d.ISA = set
+    text.Reset()
+    if err := d.HTML(&text); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(text.String(), "<td><b>&lt;SUB&amp;&gt; 3, 1, 4</b></td>") {
+        t.Errorf("escaped SUB isn't found in\n%v", text.String())
+    }
+    if strings.Contains(text.String(), "<SUB&>") {
+        t.Errorf("SUB isn't escaped in\n%v", text.String())
+    }
+}
+
+func TestUnknownFormat(t *testing.T) {
+    if err := record(t, program).Write(&strings.Builder{}, "pdf"); err == nil {
+        t.Error("no error for format pdf")
+    }
+}
+
+// Command held by stall isn't bold, it takes the operand when it moves on
+func TestHeldStage(t *testing.T) {
+    d := record(t, []uint32{
+        encode("LTR", 2, 5),
+        encode("MUL", 1, 1, 3),
+        encode("SUM", 1, 2, 4),
+        encode("HALT"),
+    })
+    //SUM reads r2 on Decode 2 while LTR is on write back, but it waits there for MUL
+    held := []string{"", "HALT", "SUM 1, 2, 4", "MUL 1, 1, 3", "LTR 2, 5"}
+    var text strings.Builder
+    if err := d.Write(&text, "csv"); err != nil {
+        t.Fatal(err)
+    }
+    records, err := csv.NewReader(strings.NewReader(text.String())).ReadAll()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !slices.Equal(records[5], held) {
+        t.Errorf("cycle 4: %q, want %q", records[5], held)
+    }
+    for i, row := range d.Rows {
+        for j, c := range row {
+            if c.Forward {
+                t.Errorf("cycle %d: %v on %v is forwarded", i, c.Text(d.ISA), isa.StageNames[j])
+            }
+        }
+    }
+}
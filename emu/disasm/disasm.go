@@ -0,0 +1,94 @@
+// Disassembler of programs
+// Its output is accepted by translator and gives the same program back
+// Words which are not commands are given as raw data by WORD pseudo-command
+package disasm
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+// Disassembled command
+type Line struct {
+    Adr   uint16
+    Cmd   uint32
+    //Label of command if something jumps to it
+    Label string
+    //Assembly language form, jump addresses are given by labels
+    Text  string
+    //Width of command word
+    width uint
+}
+
+// Line of assembly language with address and encoding of command in comment
+func (l Line) String() string {
+    label := ""
+    if l.Label != "" {
+        label = l.Label + ":"
+    }
+    return fmt.Sprintf("%-7s %-24s ; %4d %0*b", label, l.Text+";", l.Adr, l.width, l.Cmd)
+}
+
+func label(adr uint16) string {
+    return "L" + strconv.Itoa(int(adr))
+}
+
+// Program of default config
+func Program(cmds []uint32) ([]Line, error) {
+    return ProgramFor(isa.Default, cmds)
+}
+
+// Program decoded by given instruction set
+func ProgramFor(set *isa.ISA, cmds []uint32) ([]Line, error) {
+    //Commands which are jumped to get labels
+    targets := make(map[uint16]bool)
+    for _, cmd := range cmds {
+        in := command(set, cmd)
+        if in == nil {
+            continue
+        }
+        for _, f := range in.Operands {
+            if val := f.Decode(cmd); f.Kind == isa.KindCmd && int(val) < len(cmds) {
+                targets[val] = true
+            }
+        }
+    }
+
+    lines := make([]Line, len(cmds))
+    for adr, cmd := range cmds {
+        lines[adr] = Line{Adr: uint16(adr), Cmd: cmd, width: set.Width}
+        if targets[uint16(adr)] {
+            lines[adr].Label = label(uint16(adr))
+        }
+        if command(set, cmd) == nil {
+            lines[adr].Text = fmt.Sprintf("%v %d", isa.Word, cmd)
+            continue
+        }
+        lines[adr].Text = set.DisassembleWith(cmd, func(f isa.Field) string {
+            if val := f.Decode(cmd); f.Kind == isa.KindCmd && targets[val] {
+                return label(val)
+            }
+            return f.Format(cmd)
+        })
+    }
+    return lines, nil
+}
+
+//Description of command word, nil if it's unknown or has bits outside of its operands,
+//since assembly language can't give such word back
+func command(set *isa.ISA, cmd uint32) *isa.Instr {
+    in := set.Decode(cmd)
+    if in == nil {
+        return nil
+    }
+    vals := make([]uint16, len(in.Operands))
+    for i, f := range in.Operands {
+        vals[i] = f.Decode(cmd)
+    }
+    if in.Encode(vals) != cmd {
+        return nil
+    }
+    return in
+}
@@ -0,0 +1,224 @@
+package isa
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Sizes of machine, widths of fields are derived from them
+type Config struct {
+    //Cells of data memory, the last ones are taken by devices
+    Mem  int
+    //Cells of command memory
+    Cmd  int
+    //Registers, the last one is stack pointer
+    Regs int
+}
+
+var DefaultConfig = Config{Mem: 1024, Cmd: 1024, Regs: 16}
+
+func (c Config) Validate() error {
+    var errs []error
+    if c.Mem < 8 || c.Mem > 1<<16 {
+        errs = append(errs, fmt.Errorf("Memory of %d cells, it must be from 8 to 65536", c.Mem))
+    }
+    if c.Cmd < 1 || c.Cmd > 1<<16 {
+        errs = append(errs, fmt.Errorf("Command memory of %d cells, it must be from 1 to 65536", c.Cmd))
+    }
+    if c.Regs < 2 || c.Regs > 32 {
+        errs = append(errs, fmt.Errorf("%d registers, there must be from 2 to 32", c.Regs))
+    }
+    return errors.Join(errs...)
+}
+
+// Instruction set of machine with given config
+type ISA struct {
+    Config
+    Fields
+    //Width of command word in bits
+    Width    uint
+    //Register used as stack pointer
+    SP       uint16
+    Table    []Instr
+    byOpcode   map[uint8][]*Instr
+    byID       map[int]*Instr
+    byMnemonic map[string]*Instr
+}
+
+// Instruction set of default config
+var Default = mustNew(DefaultConfig)
+
+// Bits needed for addresses of n cells
+func bitsFor(n int) uint {
+    return uint(bits.Len(uint(n-1)))
+}
+
+// Address fields take the lowest bits, above them go sub field, adr_r2, adr_r1 and opcode
+// adr_r3 is right below adr_r2, and funct takes the lowest 8 bits
+// Fields are never narrower than in default config, so small machines keep its encoding
+func layout(c Config) (Fields, uint) {
+    r := max(4, bitsFor(c.Regs))
+    a := max(10, bitsFor(c.Mem), bitsFor(c.Cmd), r+6)
+    f := Fields{
+        Opcode:    Field{"opcode", KindLit, a+2+2*r, 4},
+        R1:        Field{"adr_r1", KindReg, a+2+r, r},
+        R2:        Field{"adr_r2", KindReg, a+2, r},
+        R3:        Field{"adr_r3", KindReg, a+2-r, r},
+        AdrM:      Field{"adr_m", KindMem, 0, a},
+        Literal:   Field{"literal", KindLit, a, 2*r+2},
+        AdrToJump: Field{"adr_to_jump", KindCmd, 0, a},
+        Funct:     Field{"funct", KindLit, 0, 8},
+        Sub:       Field{"sub", KindLit, a, 2},
+        Value:     Field{"value", KindLit, 0, a},
+        Delta:     Field{"delta", KindInt, 0, a},
+        Mode:      Field{"mode", KindLit, a+2+r, r},
+        Shamt:     Field{"shamt", KindLit, a+2, r},
+    }
+    return f, a+6+2*r
+}
+
+func New(c Config) (*ISA, error) {
+    if err := c.Validate(); err != nil {
+        return nil, err
+    }
+    fields, width := layout(c)
+    s := &ISA{
+        Config:     c,
+        Fields:     fields,
+        Width:      width,
+        SP:         uint16(c.Regs-1),
+        Table:      newTable(fields),
+        byOpcode:   map[uint8][]*Instr{},
+        byID:       map[int]*Instr{},
+        byMnemonic: map[string]*Instr{},
+    }
+    for i := range s.Table {
+        in := &s.Table[i]
+        in.opcode = fields.Opcode
+        s.byOpcode[in.Opcode] = append(s.byOpcode[in.Opcode], in)
+        s.byID[in.ID] = in
+        s.byMnemonic[in.Mnemonic] = in
+        for _, alias := range in.Aliases {
+            s.byMnemonic[alias] = in
+        }
+    }
+    return s, nil
+}
+
+func mustNew(c Config) *ISA {
+    s, err := New(c)
+    if err != nil {
+        panic(err)
+    }
+    return s
+}
+
+// Description of command by identifier, nil if there is no such command
+func (s *ISA) ByID(id int) *Instr {
+    return s.byID[id]
+}
+
+// Description of command by mnemonic, nil if there is no such command
+func (s *ISA) ByMnemonic(mnemonic string) *Instr {
+    return s.byMnemonic[mnemonic]
+}
+
+// Description of command word, nil if opcode or function is unknown
+func (s *ISA) Decode(cmd uint32) *Instr {
+    for _, in := range s.byOpcode[uint8(s.Opcode.Decode(cmd))] {
+        if in.Func.Decode(cmd) == in.FuncVal {
+            return in
+        }
+    }
+    return nil
+}
+
+// Assembly language form of command, empty for unknown opcodes
+// It's the form translator accepts, operands are separated by commas
+func (s *ISA) Disassemble(cmd uint32) string {
+    return s.DisassembleWith(cmd, func(f Field) string {
+        return f.Format(cmd)
+    })
+}
+
+// Assembly language form of command with operands given by operand,
+// so disassembler can put labels instead of addresses
+func (s *ISA) DisassembleWith(cmd uint32, operand func(f Field) string) string {
+    in := s.Decode(cmd)
+    if in == nil {
+        return ""
+    }
+    ops := make([]string, len(in.Operands))
+    for i, f := range in.Operands {
+        ops[i] = operand(f)
+    }
+    return strings.TrimSpace(in.Mnemonic + " " + strings.Join(ops, ", "))
+}
+
+// Amount of values operand can take: registers, memory cells or commands for addresses,
+// and values of field for the rest
+func (s *ISA) Limit(f Field) int {
+    switch f.Kind {
+    case KindReg:
+        return s.Regs
+    case KindMem:
+        return s.Mem
+    case KindCmd:
+        return s.Cmd
+    }
+    return 1 << f.Width
+}
+
+// Command fits in word and its operands fit in machine
+// Unknown commands are not checked, they raise exception when they are executed
+func (s *ISA) Check(cmd uint32) error {
+    if cmd >> s.Width != 0 {
+        return fmt.Errorf("Command %0*b is wider than %d bits", s.Width, cmd, s.Width)
+    }
+    in := s.Decode(cmd)
+    if in == nil {
+        return nil
+    }
+    for _, f := range in.Operands {
+        if val := f.Decode(cmd); f.Kind != KindInt && int(val) >= s.Limit(f) {
+            return fmt.Errorf("%v %d of %v is out of %d", f.Name, val, in.Mnemonic, s.Limit(f))
+        }
+    }
+    return nil
+}
+
+// Program assembled for config c runs on this machine:
+// encoding is the same and memories and registers are not smaller
+func (s *ISA) Holds(c Config) error {
+    fields, _ := layout(c)
+    switch {
+    case fields != s.Fields:
+        return fmt.Errorf("Program for %v is encoded for other machine than %v", c, s.Config)
+    case c.Mem > s.Mem || c.Cmd > s.Cmd || c.Regs > s.Regs:
+        return fmt.Errorf("Program for %v doesn't fit in %v", c, s.Config)
+    }
+    return nil
+}
+
+func (c Config) String() string {
+    return fmt.Sprintf("mem %d cmd %d regs %d", c.Mem, c.Cmd, c.Regs)
+}
+
+// Functions of default config
+func ByID(id int) *Instr {
+    return Default.ByID(id)
+}
+
+func ByMnemonic(mnemonic string) *Instr {
+    return Default.ByMnemonic(mnemonic)
+}
+
+func Decode(cmd uint32) *Instr {
+    return Default.Decode(cmd)
+}
+
+func Disassemble(cmd uint32) string {
+    return Default.Disassemble(cmd)
+}
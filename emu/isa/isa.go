@@ -0,0 +1,140 @@
+// Instruction set of Pennywise700
+// Both emulator and translator take encoding of commands,
+// their operands and pipeline reads and writes from here
+package isa
+
+import (
+	"strconv"
+)
+
+// Width of command word in bits in default config
+const Width = 24
+
+// Pipeline stages
+const (
+    Fetch = iota
+    Decode1
+    Decode2
+    Execute
+    WriteBack
+)
+
+var StageNames = [...]string{"Fetch", "Decode 1", "Decode 2", "Execute", "Write Back"}
+
+// Kind of value kept in operand field
+type Kind uint8
+
+const (
+    KindLit Kind = iota //literal
+    KindReg             //register address
+    KindMem             //data memory address
+    KindCmd             //command memory address, can be given by label
+    KindInt             //signed literal in two's complement
+)
+
+// Bit field of command word
+type Field struct {
+    Name  string
+    Kind  Kind
+    Shift uint
+    Width uint
+}
+
+func (f Field) Mask() uint32 {
+    return (1<<f.Width - 1) << f.Shift
+}
+
+func (f Field) Decode(cmd uint32) uint16 {
+    return uint16(cmd & f.Mask() >> f.Shift)
+}
+
+func (f Field) Encode(val uint16) uint32 {
+    return uint32(val) << f.Shift & f.Mask()
+}
+
+// Value of field with its highest bit taken as sign
+func (f Field) Signed(cmd uint32) int16 {
+    unused := 16 - f.Width
+    return int16(f.Decode(cmd) << unused) >> unused
+}
+
+// Value of field as it's written in assembly language, signed for KindInt
+func (f Field) Format(cmd uint32) string {
+    if f.Kind == KindInt {
+        return strconv.Itoa(int(f.Signed(cmd)))
+    }
+    return strconv.Itoa(int(f.Decode(cmd)))
+}
+
+// Place where operand is read from or written to
+type Loc uint8
+
+const (
+    Imm    Loc = iota //value of field itself
+    Reg               //RF[field]
+    Mem               //mem[field]
+    MemInd            //mem[RF[field]], address goes through ALU as Op1
+    PC                //program counter, address of the next command when it's read
+    StackPtr          //RF[SP], field is not used
+    StackTop          //mem[RF[SP]], address goes through ALU as Op1
+    StackNext         //mem[RF[SP]-1], cell value is pushed to, RF[SP] goes through ALU as Op1
+    Flags             //flags register, hazards are tracked as for register FlagsReg
+)
+
+// Read or write of command on some pipeline stage
+type Access struct {
+    Stage int
+    Loc   Loc
+    Field Field
+    //ALU operand which gets the value, 3 for ALU flags, 0 if write back uses it directly
+    Op    int
+}
+
+// Description of command
+type Instr struct {
+    Mnemonic string
+    //Other mnemonics giving the same command
+    Aliases  []string
+    //Identifier of command, emulator tells commands apart by it
+    ID       int
+    Opcode   uint8
+    //Commands with the same opcode are told apart by value of Func field,
+    //it has zero width if opcode belongs to one command
+    Func     Field
+    FuncVal  uint16
+    //Fields in order of assembly language
+    Operands []Field
+    Reads    []Access
+    Writes   []Access
+    //Opcode field of instruction set command belongs to
+    opcode   Field
+}
+
+// Command word with given operands, they go in order of Operands
+func (in *Instr) Encode(vals []uint16) uint32 {
+    cmd := in.opcode.Encode(uint16(in.Opcode)) | in.Func.Encode(in.FuncVal)
+    for i, f := range in.Operands {
+        cmd |= f.Encode(vals[i])
+    }
+    return cmd
+}
+
+// Command reads loc on some stage
+func (in *Instr) ReadsFrom(loc Loc) bool {
+    for _, r := range in.Reads {
+        if r.Loc == loc {
+            return true
+        }
+    }
+    return false
+}
+
+// Command writes loc on some stage
+func (in *Instr) WritesTo(loc Loc) bool {
+    for _, w := range in.Writes {
+        if w.Loc == loc {
+            return true
+        }
+    }
+    return false
+}
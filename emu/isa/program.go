@@ -0,0 +1,69 @@
+package isa
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Program is kept as text, every command is a line of Width binary digits
+// Program for other config than DefaultConfig starts with header line "# mem 4096 cmd 1024 regs 16"
+
+// Pseudo-command of assembly language, its operand is put to command memory as it is
+// Disassembler gives words which are not commands this way
+const Word = "WORD"
+
+func ReadProgram(r io.Reader) ([]uint32, error) {
+    cmds, _, err := ReadProgramConfig(r)
+    return cmds, err
+}
+
+// Program and config it's assembled for
+func ReadProgramConfig(r io.Reader) ([]uint32, Config, error) {
+    cmds := make([]uint32, 0)
+    c, s := DefaultConfig, Default
+    scanner := bufio.NewScanner(r)
+    for line := 1; scanner.Scan(); line++ {
+        text := scanner.Text()
+        if line == 1 && strings.HasPrefix(text, "#") {
+            _, err := fmt.Sscanf(text, "# mem %d cmd %d regs %d", &c.Mem, &c.Cmd, &c.Regs)
+            if err == nil {
+                s, err = New(c)
+            }
+            if err != nil {
+                return nil, c, fmt.Errorf("Bad header %q: %v", text, err)
+            }
+            continue
+        }
+        cmd, err := strconv.ParseUint(text, 2, int(s.Width))
+        if err != nil {
+            return nil, c, fmt.Errorf("%v in line %d", err, line)
+        }
+        cmds = append(cmds, uint32(cmd))
+    }
+    return cmds, c, scanner.Err()
+}
+
+func WriteProgram(w io.Writer, cmds []uint32) error {
+    return WriteProgramConfig(w, cmds, DefaultConfig)
+}
+
+// Header is written only if config is not DefaultConfig, so default programs stay as they were
+func WriteProgramConfig(w io.Writer, cmds []uint32, c Config) error {
+    s, err := New(c)
+    if err != nil {
+        return err
+    }
+    writer := bufio.NewWriter(w)
+    if c != DefaultConfig {
+        fmt.Fprintf(writer, "# %v\n", c)
+    }
+    for _, cmd := range cmds {
+        if _, err := fmt.Fprintf(writer, "%0*b\n", s.Width, cmd); err != nil {
+            return err
+        }
+    }
+    return writer.Flush()
+}
@@ -0,0 +1,418 @@
+package isa
+
+// Identifiers of commands
+const (
+    NOP = iota
+    LTM
+    MTR
+    RTR
+    SUB
+    JGEU
+    MTRK
+    RTMK
+    JMP
+    SUM
+    AND
+    OR
+    XOR
+    NOT
+    HALT
+    SHL
+    SHR
+    SAR
+    ROL
+    ROR
+    SHLI
+    SHRI
+    SARI
+    ROLI
+    RORI
+    MUL
+    DIV
+    MOD
+    LTR
+    ADDI
+    JLTU
+    JEQ
+    JNE
+    JGE
+    JLT
+    CALL
+    RET
+    PUSH
+    POP
+    JR
+    ADC
+    SBC
+    JZ
+    JNZ
+    JC
+    JNC
+    JN
+    JNN
+    JV
+    JNV
+)
+
+// Register used as stack pointer in default config, it's the last register
+const SP = 15
+
+// Flags register isn't in RF, but it's told apart from registers by this number
+const FlagsReg = 0xFFFF
+
+// Bits of flags register
+const (
+    FlagZ = 1 << iota //result is zero
+    FlagC             //carry out of addition, borrow of subtraction
+    FlagV             //signed overflow
+    FlagN             //result is negative
+)
+
+// Old name of JGEU, it gives the same command
+const JUMP_LESS = JGEU
+
+// Opcode of commands told apart by Funct field
+const Ext = 0xF
+
+// Fields of command word, their widths are derived from Config
+//Default layout is [OpCode 23:20][adr_r1 19:16][adr_r2 15:12][adr_r3 11:8]
+//literal and addresses are packed from the lowest bit: [literal 19:10][adr 9:0]
+//Commands with opcode Ext keep function in the lowest bits: [funct 7:0]
+type Fields struct {
+    Opcode    Field
+    R1        Field
+    R2        Field
+    R3        Field
+    AdrM      Field
+    Literal   Field
+    AdrToJump Field
+    Funct     Field
+    //Commands sharing opcode 0x2, 0x5 or 0xE are told apart by sub field
+    //Literals of LTR and ADDI take the place of adr_m
+    Sub       Field
+    Value     Field
+    Delta     Field
+    //Commands sharing opcode 0x8 are told apart by mode field in place of adr_r1
+    Mode      Field
+    //Shift amount given instead of adr_r2
+    Shamt     Field
+}
+
+// Fields of default config
+var (
+    Opcode    = Default.Opcode
+    R1        = Default.R1
+    R2        = Default.R2
+    R3        = Default.R3
+    AdrM      = Default.AdrM
+    Literal   = Default.Literal
+    AdrToJump = Default.AdrToJump
+    Funct     = Default.Funct
+    Sub       = Default.Sub
+    Value     = Default.Value
+    Delta     = Default.Delta
+    Mode      = Default.Mode
+    Shamt     = Default.Shamt
+)
+
+// Commands of default config
+var Table = Default.Table
+
+// Commands with fields of given layout
+func newTable(f Fields) []Instr {
+    return []Instr{
+        {
+            Mnemonic: "NOP", ID: NOP, Opcode: 0x0,
+        },
+        {
+            Mnemonic: "LTM", ID: LTM, Opcode: 0x1,
+            Operands: []Field{f.Literal, f.AdrM},
+            Reads:    []Access{{Decode1, Imm, f.Literal, 1}},
+            Writes:   []Access{{WriteBack, Mem, f.AdrM, 0}},
+        },
+        {
+            Mnemonic: "MTR", ID: MTR, Opcode: 0x2, Func: f.Sub, FuncVal: 0,
+            Operands: []Field{f.R1, f.AdrM},
+            Reads:    []Access{{Decode2, Mem, f.AdrM, 1}},
+            Writes:   []Access{{WriteBack, Reg, f.R1, 0}},
+        },
+        {
+            Mnemonic: "LTR", ID: LTR, Opcode: 0x2, Func: f.Sub, FuncVal: 1,
+            Operands: []Field{f.R1, f.Value},
+            Reads:    []Access{{Decode1, Imm, f.Value, 1}},
+            Writes:   []Access{{WriteBack, Reg, f.R1, 0}},
+        },
+        {
+            Mnemonic: "ADDI", ID: ADDI, Opcode: 0x2, Func: f.Sub, FuncVal: 2,
+            Operands: []Field{f.R1, f.Delta},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Imm, f.Delta, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R1, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "RTR", ID: RTR, Opcode: 0x3,
+            Operands: []Field{f.R1, f.R2},
+            Reads:    []Access{{Decode1, Reg, f.R2, 1}},
+            Writes:   []Access{{WriteBack, Reg, f.R1, 0}},
+        },
+        {
+            Mnemonic: "SUB", ID: SUB, Opcode: 0x4,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "JGEU", Aliases: []string{"JUMP_LESS"}, ID: JGEU, Opcode: 0x5, Func: f.Sub, FuncVal: 0,
+            Operands: []Field{f.R1, f.R2, f.AdrToJump},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JLTU", ID: JLTU, Opcode: 0x5, Func: f.Sub, FuncVal: 1,
+            Operands: []Field{f.R1, f.R2, f.AdrToJump},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JEQ", ID: JEQ, Opcode: 0x5, Func: f.Sub, FuncVal: 2,
+            Operands: []Field{f.R1, f.R2, f.AdrToJump},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JNE", ID: JNE, Opcode: 0x5, Func: f.Sub, FuncVal: 3,
+            Operands: []Field{f.R1, f.R2, f.AdrToJump},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JGE", ID: JGE, Opcode: 0xE, Func: f.Sub, FuncVal: 0,
+            Operands: []Field{f.R1, f.R2, f.AdrToJump},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JLT", ID: JLT, Opcode: 0xE, Func: f.Sub, FuncVal: 1,
+            Operands: []Field{f.R1, f.R2, f.AdrToJump},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "MTRK", ID: MTRK, Opcode: 0x6,
+            Operands: []Field{f.R1, f.R2},
+            Reads:    []Access{{Decode1, Reg, f.R2, 1}, {WriteBack, MemInd, f.R2, 0}},
+            Writes:   []Access{{WriteBack, Reg, f.R1, 0}},
+        },
+        {
+            Mnemonic: "RTMK", ID: RTMK, Opcode: 0x7,
+            Operands: []Field{f.R1, f.R2},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {WriteBack, Reg, f.R2, 0}},
+            Writes:   []Access{{WriteBack, MemInd, f.R1, 0}},
+        },
+        {
+            Mnemonic: "JMP", ID: JMP, Opcode: 0x8, Func: f.Mode, FuncVal: 0,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode1, Imm, f.AdrToJump, 1}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "CALL", ID: CALL, Opcode: 0x8, Func: f.Mode, FuncVal: 1,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode1, StackPtr, Field{}, 1}, {Decode2, PC, Field{}, 2}},
+            Writes:   []Access{{WriteBack, StackNext, Field{}, 0}, {WriteBack, StackPtr, Field{}, 0}, {WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "SUM", ID: SUM, Opcode: 0x9,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "AND", ID: AND, Opcode: 0xA,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "OR", ID: OR, Opcode: 0xB,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "XOR", ID: XOR, Opcode: 0xC,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "NOT", ID: NOT, Opcode: 0xD,
+            Operands: []Field{f.R1, f.R2},
+            Reads:    []Access{{Decode1, Reg, f.R2, 1}},
+            Writes:   []Access{{WriteBack, Reg, f.R1, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "HALT", ID: HALT, Opcode: Ext, Func: f.Funct, FuncVal: 0x00,
+        },
+        {
+            Mnemonic: "SHL", ID: SHL, Opcode: Ext, Func: f.Funct, FuncVal: 0x01,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "SHR", ID: SHR, Opcode: Ext, Func: f.Funct, FuncVal: 0x02,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "SAR", ID: SAR, Opcode: Ext, Func: f.Funct, FuncVal: 0x03,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "ROL", ID: ROL, Opcode: Ext, Func: f.Funct, FuncVal: 0x04,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "ROR", ID: ROR, Opcode: Ext, Func: f.Funct, FuncVal: 0x05,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "SHLI", ID: SHLI, Opcode: Ext, Func: f.Funct, FuncVal: 0x09,
+            Operands: []Field{f.R1, f.Shamt, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Imm, f.Shamt, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "SHRI", ID: SHRI, Opcode: Ext, Func: f.Funct, FuncVal: 0x0A,
+            Operands: []Field{f.R1, f.Shamt, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Imm, f.Shamt, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "SARI", ID: SARI, Opcode: Ext, Func: f.Funct, FuncVal: 0x0B,
+            Operands: []Field{f.R1, f.Shamt, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Imm, f.Shamt, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "ROLI", ID: ROLI, Opcode: Ext, Func: f.Funct, FuncVal: 0x0C,
+            Operands: []Field{f.R1, f.Shamt, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Imm, f.Shamt, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "RORI", ID: RORI, Opcode: Ext, Func: f.Funct, FuncVal: 0x0D,
+            Operands: []Field{f.R1, f.Shamt, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Imm, f.Shamt, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "MUL", ID: MUL, Opcode: Ext, Func: f.Funct, FuncVal: 0x10,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}},
+        },
+        {
+            Mnemonic: "DIV", ID: DIV, Opcode: Ext, Func: f.Funct, FuncVal: 0x11,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}},
+        },
+        {
+            Mnemonic: "MOD", ID: MOD, Opcode: Ext, Func: f.Funct, FuncVal: 0x12,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}},
+        },
+        {
+            Mnemonic: "RET", ID: RET, Opcode: Ext, Func: f.Funct, FuncVal: 0x20,
+            Reads:    []Access{{Decode1, StackPtr, Field{}, 1}, {WriteBack, StackTop, Field{}, 0}},
+            Writes:   []Access{{WriteBack, StackPtr, Field{}, 0}, {WriteBack, PC, Field{}, 0}},
+        },
+        {
+            Mnemonic: "PUSH", ID: PUSH, Opcode: Ext, Func: f.Funct, FuncVal: 0x21,
+            Operands: []Field{f.R1},
+            Reads:    []Access{{Decode1, StackPtr, Field{}, 1}, {Decode2, Reg, f.R1, 2}},
+            Writes:   []Access{{WriteBack, StackNext, Field{}, 0}, {WriteBack, StackPtr, Field{}, 0}},
+        },
+        {
+            Mnemonic: "POP", ID: POP, Opcode: Ext, Func: f.Funct, FuncVal: 0x22,
+            Operands: []Field{f.R1},
+            Reads:    []Access{{Decode1, StackPtr, Field{}, 1}, {WriteBack, StackTop, Field{}, 0}},
+            Writes:   []Access{{WriteBack, StackPtr, Field{}, 0}, {WriteBack, Reg, f.R1, 0}},
+        },
+        {
+            Mnemonic: "JR", ID: JR, Opcode: Ext, Func: f.Funct, FuncVal: 0x23,
+            Operands: []Field{f.R1},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}},
+            Writes:   []Access{{WriteBack, PC, Field{}, 0}},
+        },
+        {
+            Mnemonic: "ADC", ID: ADC, Opcode: Ext, Func: f.Funct, FuncVal: 0x13,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}, {Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "SBC", ID: SBC, Opcode: Ext, Func: f.Funct, FuncVal: 0x14,
+            Operands: []Field{f.R1, f.R2, f.R3},
+            Reads:    []Access{{Decode1, Reg, f.R1, 1}, {Decode2, Reg, f.R2, 2}, {Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, Reg, f.R3, 0}, {WriteBack, Flags, Field{}, 0}},
+        },
+        {
+            Mnemonic: "JZ", ID: JZ, Opcode: 0x8, Func: f.Mode, FuncVal: 2,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JNZ", ID: JNZ, Opcode: 0x8, Func: f.Mode, FuncVal: 3,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JC", ID: JC, Opcode: 0x8, Func: f.Mode, FuncVal: 4,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JNC", ID: JNC, Opcode: 0x8, Func: f.Mode, FuncVal: 5,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JN", ID: JN, Opcode: 0x8, Func: f.Mode, FuncVal: 6,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JNN", ID: JNN, Opcode: 0x8, Func: f.Mode, FuncVal: 7,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JV", ID: JV, Opcode: 0x8, Func: f.Mode, FuncVal: 8,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+        {
+            Mnemonic: "JNV", ID: JNV, Opcode: 0x8, Func: f.Mode, FuncVal: 9,
+            Operands: []Field{f.AdrToJump},
+            Reads:    []Access{{Decode2, Flags, Field{}, 3}},
+            Writes:   []Access{{WriteBack, PC, f.AdrToJump, 0}},
+        },
+    }
+}
@@ -2,21 +2,8 @@ package pipeline
 
 import (
 	"fmt"
-	"strconv"
-	"sync"
-)
 
-const (
-    NOP = iota
-    LTM
-    MTR
-    RTR
-    SUB
-    JUMP_LESS
-    MTRK
-    RTMK
-    JMP
-    SUM
+	"github.com/Tyulenb/Pennywise700/isa"
 )
 
 //Imitation of Arithmetic Logic Unit
@@ -24,6 +11,8 @@ type ALU struct {
 	Op1 uint16
 	Op2 uint16
 	Res uint16
+	//Flags read by command before Execute, flags of result after it
+	Flags uint16
 }
 
 func (a *ALU) ToString() string {
@@ -32,190 +21,212 @@ func (a *ALU) ToString() string {
 
 // The pipeline emits a conveyor
 // Commands to be executed at each stage will be written in pipe
-// Mutex is needed to eliminate race conditions
+// Pipe, Alu and stall flags are latches, they change only on the clock edge
 type Pipeline struct {
 	Pipe []uint32
     M3 bool
     M4 bool
+    //Command stays on Execute, bubble goes to Write Back
+    M5 bool
     Alu []ALU
-    Mtx sync.Mutex
-}
-
-func NewPipeline(stages int) *Pipeline {
+    //Address each command was fetched from
+    Adr []uint16
+    //Address fetched after each command, it's predicted for jumps
+    Next []uint16
+    //False for bubbles, which are NOPs put in pipe by stalls and jumps
+    Valid []bool
+    //True for bubbles put in pipe by stalls
+    Stall []bool
+    //Commands are decoded by instruction set of machine
+    ISA   *isa.ISA
+}
+
+func NewPipeline(stages int, set *isa.ISA) *Pipeline {
     return &Pipeline{
+        ISA: set,
         Pipe: make([]uint32, stages),
         Alu: make([]ALU, stages),
+        Adr: make([]uint16, stages),
+        Next: make([]uint16, stages),
+        Valid: make([]bool, stages),
+        Stall: make([]bool, stages),
     }
 }
 
 //Read new cmd and moves pipeline stages for next step
-func (p *Pipeline) Move(cmd uint32) {
-    p.Mtx.Lock()
-    defer p.Mtx.Unlock()
-
-    if p.M4 {
-        p.Pipe[4] = p.Pipe[3]
-        p.Alu[4] = p.Alu[3]
-        p.Pipe[3] = 0
-        p.Alu[3] = ALU{}
+//Bubble is put to Fetch if valid is false, the next command is fetched from adr+1
+func (p *Pipeline) Move(cmd uint32, adr uint16, valid bool) {
+    if p.M5 {
+        p.shift(5, 4)
+    }else if p.M4 {
+        p.shift(4, 3)
     }else if p.M3 {
-        for i := len(p.Pipe)-1; i >= 3; i-- {
-            p.Pipe[i] = p.Pipe[i-1]
-            p.Alu[i] = p.Alu[i-1]
-        }
-        p.Pipe[2] = 0
-        p.Alu[2] = ALU{}
+        p.shift(3, 2)
     }else {
-        for i := len(p.Pipe)-1; i >= 1; i-- {
-            p.Pipe[i] = p.Pipe[i-1]
-            p.Alu[i] = p.Alu[i-1]
-        }
+        p.shift(1, 0)
     } 
     p.M3 = false
     p.M4 = false
+    p.M5 = false
 
     p.Pipe[0] = cmd
     p.Alu[0] = ALU{}
+    p.Adr[0] = adr
+    p.Next[0] = adr+1
+    p.Valid[0] = valid
+    p.Stall[0] = false
+}
+
+//Commands from stage to the end move one stage further
+//and bubble is put instead of command on stage-1
+func (p *Pipeline) shift(stage int, bubble int) {
+    for i := len(p.Pipe)-1; i >= stage; i-- {
+        p.Pipe[i] = p.Pipe[i-1]
+        p.Alu[i] = p.Alu[i-1]
+        p.Adr[i] = p.Adr[i-1]
+        p.Next[i] = p.Next[i-1]
+        p.Valid[i] = p.Valid[i-1]
+        p.Stall[i] = p.Stall[i-1]
+    }
+    p.clear(bubble)
+    p.Stall[bubble] = true
+}
+
+func (p *Pipeline) clear(stage int) {
+    p.Pipe[stage] = 0
+    p.Alu[stage] = ALU{}
+    p.Valid[stage] = false
+    p.Stall[stage] = false
 }
 
 func (p *Pipeline) FetchOpcode(stage int) uint8 {
-    return uint8(p.Pipe[stage] & 0x00F00000 >> 20)
+    return uint8(p.Decode(stage, p.ISA.Opcode))
+}
+
+//Description of command on stage, unknown commands do nothing like NOP
+func (p *Pipeline) Instr(stage int) *isa.Instr {
+    if in := p.ISA.Decode(p.Pipe[stage]); in != nil {
+        return in
+    }
+    return p.ISA.ByID(isa.NOP)
+}
+
+//Identifier of command on stage, NOP for unknown commands
+func (p *Pipeline) Op(stage int) int {
+    return p.Instr(stage).ID
+}
+
+func (p *Pipeline) Decode(stage int, f isa.Field) uint16 {
+    return f.Decode(p.Pipe[stage])
+}
+
+func (p *Pipeline) DecodeSigned(stage int, f isa.Field) int16 {
+    return f.Signed(p.Pipe[stage])
 }
 
 func (p *Pipeline) DecodeAdrR1(stage int) uint16 {
-    return uint16(p.Pipe[stage] & 0x000F0000 >> 16)
+    return p.Decode(stage, p.ISA.R1)
 }
 
 func (p *Pipeline) DecodeAdrR2(stage int) uint16 {
-    return uint16(p.Pipe[stage] & 0x0000F000 >> 12)
+    return p.Decode(stage, p.ISA.R2)
 }
 
 func (p *Pipeline) DecodeAdrR3(stage int) uint16 {
-    return uint16(p.Pipe[stage] & 0x00000F00 >> 8)
+    return p.Decode(stage, p.ISA.R3)
 }
 
 func (p *Pipeline) DecodeAdrM(stage int) uint16 {
-    return uint16(p.Pipe[stage] & 0x000003FF)
+    return p.Decode(stage, p.ISA.AdrM)
 }
 
 func (p *Pipeline) DecodeLiteral(stage int) uint16 {
-    return uint16(p.Pipe[stage] & 0x000FFC00 >> 10) 
+    return p.Decode(stage, p.ISA.Literal)
 }
 
 func (p *Pipeline) DecodeAdrToJump(stage int) uint16 {
-    return p.DecodeAdrM(stage) 
+    return p.Decode(stage, p.ISA.AdrToJump)
 }
 
 func (p *Pipeline) DropPipe() {
-    for i := range 4 {
-        p.Pipe[i] = 0
+    p.DropYounger(4)
+}
+
+//Drops commands fetched after command on stage, it stays with older ones
+func (p *Pipeline) DropYounger(stage int) {
+    for i := range stage {
+        p.clear(i)
     }
 }
 
+//Register or data memory cell
+type Operand struct {
+    Mem bool
+    Adr uint16
+}
+
 //Get operands to be read on Decode 1 stage
-func (p *Pipeline) GetReadOpsD1(stage int) (r_adr uint16, skip bool) {
-    skip = true
-    opcode := p.FetchOpcode(stage)
-    switch opcode {
-    case RTR, MTRK:
-        r_adr = p.DecodeAdrR2(stage)
-        skip = false
-    case SUB, JUMP_LESS, SUM, RTMK:
-        r_adr = p.DecodeAdrR1(stage)
-        skip = false
-    }
-    return
+func (p *Pipeline) GetReadOpsD1(stage int) []Operand {
+    return p.getReadOps(stage, isa.Decode1)
 }
 
 //Get operands to be read on Decode 2 stage
-func (p *Pipeline) GetReadOpsD2(stage int) (adr_m, adr_r uint16, skip bool) {
-    adr_m, adr_r, skip = 0, 0, true
-    opcode := p.FetchOpcode(stage)
-    switch opcode {
-    case SUB, JUMP_LESS, SUM:
-        adr_r = p.DecodeAdrR2(stage)
-        skip = false
-    case MTR:
-        adr_m = p.DecodeAdrM(stage)
-        skip = false
+func (p *Pipeline) GetReadOpsD2(stage int) []Operand {
+    return p.getReadOps(stage, isa.Decode2)
+}
+
+func (p *Pipeline) getReadOps(stage int, at int) []Operand {
+    ops := make([]Operand, 0, 2)
+    for _, r := range p.Instr(stage).Reads {
+        if r.Stage != at {
+            continue
+        }
+        switch r.Loc {
+        case isa.Reg:
+            ops = append(ops, Operand{false, p.Decode(stage, r.Field)})
+        case isa.Mem:
+            ops = append(ops, Operand{true, p.Decode(stage, r.Field)})
+        case isa.StackPtr:
+            ops = append(ops, Operand{false, p.ISA.SP})
+        case isa.Flags:
+            ops = append(ops, Operand{false, isa.FlagsReg})
+        }
     }
-    return
-}
-
-func (p *Pipeline) GetWriteOps(stage int) (adr_m, adr_r uint16, skip bool) {
-    adr_m, adr_r, skip = 0, 0, true
-    opcode := p.FetchOpcode(stage)
-    switch opcode {
-    case LTM:
-        adr_m = p.DecodeAdrM(stage)
-        skip = false
-    case MTR, RTR, MTRK, RTMK:
-        adr_r = p.DecodeAdrR1(stage)
-        skip = false
-    case SUB, SUM:
-        adr_r = p.DecodeAdrR3(stage)
-        skip = false
+    return ops
+}
+
+//Get operands to be written on write back
+//Command must be past Decode 1, since indirect address is read there
+func (p *Pipeline) GetWriteOps(stage int) []Operand {
+    ops := make([]Operand, 0, 1)
+    for _, w := range p.Instr(stage).Writes {
+        switch w.Loc {
+        case isa.Reg:
+            ops = append(ops, Operand{false, p.Decode(stage, w.Field)})
+        case isa.Mem:
+            ops = append(ops, Operand{true, p.Decode(stage, w.Field)})
+        case isa.MemInd:
+            ops = append(ops, Operand{true, p.Alu[stage].Op1})
+        case isa.StackPtr:
+            ops = append(ops, Operand{false, p.ISA.SP})
+        case isa.StackNext:
+            ops = append(ops, Operand{true, p.Alu[stage].Op1 - 1})
+        case isa.Flags:
+            ops = append(ops, Operand{false, isa.FlagsReg})
+        }
     }
-    return
+    return ops
 }
 
 func (p *Pipeline) PipeToString() [5]string {
     result := [5]string{}
     for i := range p.Pipe {
-        result[i] = commandToString(p.Pipe[i])
+        result[i] = p.ISA.Disassemble(p.Pipe[i])
     }
     return result 
 }
 
 // Public func to convert commands
 func (p *Pipeline) CommandToString(stage int) string {
-    return commandToString(p.Pipe[stage])
-}
-
-// Private func to convert commands
-func commandToString(cmd uint32) string {
-    opcode := cmd & 0x00F00000 >> 20
-    switch opcode {
-    case NOP:
-        return "NOP"
-    case LTM:
-        lit := cmd & 0x000FFC00 >> 10
-        adr_m := cmd & 0x000003FF 
-        return fmt.Sprintf("LTM %v %v", strconv.Itoa(int(lit)), strconv.Itoa(int(adr_m)))
-    case MTR:
-        adr_r := cmd & 0x000F0000>>16 
-        adr_m := cmd & 0x000003FF 
-        return fmt.Sprintf("MTR %v %v", strconv.Itoa(int(adr_r)), strconv.Itoa(int(adr_m)))
-    case RTR:
-        adr_r1 := cmd & 0x000F0000>>16 
-        adr_r2 := cmd & 0x0000F000>>12 
-        return fmt.Sprintf("RTR %v %v", strconv.Itoa(int(adr_r1)), strconv.Itoa(int(adr_r2)))
-    case SUB:
-        adr_r1 := cmd & 0x000F0000>>16 
-        adr_r2 := cmd & 0x0000F000>>12 
-        adr_r3 := cmd & 0x00000F00>>8
-        return fmt.Sprintf("SUB %v %v %v", strconv.Itoa(int(adr_r1)), strconv.Itoa(int(adr_r2)), strconv.Itoa(int(adr_r3)))
-    case JUMP_LESS:
-        adr_r1 := cmd & 0x000F0000>>16 
-        adr_r2 := cmd & 0x0000F000>>12 
-        adr_m := cmd & 0x000003FF
-        return fmt.Sprintf("JUMP_LESS %v %v %v", strconv.Itoa(int(adr_r1)), strconv.Itoa(int(adr_r2)), strconv.Itoa(int(adr_m)))
-    case MTRK:
-        adr_r1 := cmd & 0x000F0000>>16 
-        adr_r2 := cmd & 0x0000F000>>12 
-        return fmt.Sprintf("MTRK %v %v", strconv.Itoa(int(adr_r1)), strconv.Itoa(int(adr_r2)))
-    case RTMK:
-        adr_r1 := cmd & 0x000F0000>>16 
-        adr_r2 := cmd & 0x0000F000>>12 
-        return fmt.Sprintf("RTMK %v %v", strconv.Itoa(int(adr_r1)), strconv.Itoa(int(adr_r2)))
-    case JMP:
-        adr_to_jmp := cmd & 0x000003FF
-        return fmt.Sprintf("JMP %v", adr_to_jmp)
-    case SUM:
-        adr_r1 := cmd & 0x000F0000>>16 
-        adr_r2 := cmd & 0x0000F000>>12 
-        adr_r3 := cmd & 0x00000F00>>8
-        return fmt.Sprintf("SUM %v %v %v", strconv.Itoa(int(adr_r1)), strconv.Itoa(int(adr_r2)), strconv.Itoa(int(adr_r3)))
-    }
-    return ""
+    return p.ISA.Disassemble(p.Pipe[stage])
 }
@@ -0,0 +1,171 @@
+// Branch predictors, they tell fetch where to go after a jump
+// before the jump is resolved
+package predict
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Control command as it's seen on Fetch
+type Branch struct {
+    //Address of the command
+    Pc     uint16
+    //Jump address is given in command, false for JR and RET
+    Direct bool
+    //Jump address of direct command
+    Target uint16
+    //Jump is taken every time: JMP, CALL, JR and RET
+    Always bool
+}
+
+// Predictor is asked on Fetch and told the outcome on the stage the branch is resolved on
+type Predictor interface {
+    //Whether branch is taken and where it goes, target is ignored if it's not taken
+    Predict(b Branch) (taken bool, target uint16)
+    //Branch was resolved, target is where it went if it was taken
+    Update(b Branch, taken bool, target uint16)
+}
+
+// Entries of tables, they are indexed by the low bits of address
+const (
+    TableSize = 64
+    BTBSize   = 16
+)
+
+// Every branch falls through, commands after it are fetched
+type NotTaken struct{}
+
+func (NotTaken) Predict(b Branch) (bool, uint16) {
+    return false, 0
+}
+
+func (NotTaken) Update(b Branch, taken bool, target uint16) {}
+
+// Backward jumps are taken and forward ones fall through, loops go back
+// Direct jumps which are always taken are taken, JR and RET fall through
+type BTFN struct{}
+
+func (BTFN) Predict(b Branch) (bool, uint16) {
+    if !b.Direct {
+        return false, 0
+    }
+    return b.Always || b.Target <= b.Pc, b.Target
+}
+
+func (BTFN) Update(b Branch, taken bool, target uint16) {}
+
+// Branch goes the way it went last time
+// Target is known only for direct jumps, JR and RET fall through
+type OneBit struct {
+    taken []bool
+}
+
+func NewOneBit(entries int) *OneBit {
+    return &OneBit{make([]bool, entries)}
+}
+
+func (o *OneBit) Predict(b Branch) (bool, uint16) {
+    return b.Direct && o.taken[int(b.Pc)%len(o.taken)], b.Target
+}
+
+func (o *OneBit) Update(b Branch, taken bool, target uint16) {
+    o.taken[int(b.Pc)%len(o.taken)] = taken
+}
+
+// Bimodal predictor, a 2-bit saturating counter per entry
+// Branch is taken if counter is 2 or 3, so one odd outcome doesn't change prediction
+type TwoBit struct {
+    counters []uint8
+}
+
+//Counters start weakly not taken
+func NewTwoBit(entries int) *TwoBit {
+    t := &TwoBit{make([]uint8, entries)}
+    for i := range t.counters {
+        t.counters[i] = 1
+    }
+    return t
+}
+
+func (t *TwoBit) Predict(b Branch) (bool, uint16) {
+    return b.Direct && t.counters[int(b.Pc)%len(t.counters)] >= 2, b.Target
+}
+
+func (t *TwoBit) Update(b Branch, taken bool, target uint16) {
+    i := int(b.Pc) % len(t.counters)
+    t.counters[i] = count(t.counters[i], taken)
+}
+
+//2-bit saturating counter moved towards the outcome
+func count(c uint8, taken bool) uint8 {
+    if taken {
+        return min(c+1, 3)
+    }
+    return max(c, 1) - 1
+}
+
+// Branch target buffer, it keeps address and target of taken branches with 2-bit counters
+// Targets of JR and RET are remembered as well, so they can be predicted too
+type BTB struct {
+    entries []entry
+}
+
+type entry struct {
+    valid   bool
+    pc      uint16
+    target  uint16
+    counter uint8
+}
+
+func NewBTB(entries int) *BTB {
+    return &BTB{make([]entry, entries)}
+}
+
+func (t *BTB) lookup(pc uint16) *entry {
+    return &t.entries[int(pc)%len(t.entries)]
+}
+
+func (t *BTB) Predict(b Branch) (bool, uint16) {
+    e := t.lookup(b.Pc)
+    if !e.valid || e.pc != b.Pc || e.counter < 2 {
+        return false, 0
+    }
+    return true, e.target
+}
+
+//Taken branch takes the entry, it starts weakly taken
+//Branch which isn't in the buffer and falls through doesn't get an entry
+func (t *BTB) Update(b Branch, taken bool, target uint16) {
+    e := t.lookup(b.Pc)
+    if !e.valid || e.pc != b.Pc {
+        if taken {
+            *e = entry{true, b.Pc, target, 2}
+        }
+        return
+    }
+    e.counter = count(e.counter, taken)
+    if taken {
+        e.target = target
+    }
+}
+
+// Names of predictors in order from the simplest
+var Names = []string{"not-taken", "btfn", "1bit", "2bit", "btb"}
+
+// New predictor by name, one of Names
+func Parse(name string) (Predictor, error) {
+    switch name {
+    case "not-taken":
+        return NotTaken{}, nil
+    case "btfn":
+        return BTFN{}, nil
+    case "1bit":
+        return NewOneBit(TableSize), nil
+    case "2bit":
+        return NewTwoBit(TableSize), nil
+    case "btb":
+        return NewBTB(BTBSize), nil
+    }
+    return nil, fmt.Errorf("Unknown predictor %v, expected %v", name, strings.Join(Names, ", "))
+}
@@ -0,0 +1,146 @@
+package predict
+
+import "testing"
+
+// Conditional forward branch at 10 to 20
+var forward = Branch{Pc: 10, Direct: true, Target: 20}
+
+// Outcomes are given to predictor in order, prediction is checked before each of them
+type step struct {
+    taken bool
+    //Prediction before the outcome
+    want  bool
+}
+
+func run(t *testing.T, name string, p Predictor, b Branch, steps []step) {
+    t.Helper()
+    for i, s := range steps {
+        if taken, _ := p.Predict(b); taken != s.want {
+            t.Errorf("%v, step %d: predicted taken %v, want %v", name, i, taken, s.want)
+        }
+        p.Update(b, s.taken, b.Target)
+    }
+}
+
+func TestTwoBit(t *testing.T) {
+    //Counter starts weakly not taken, two taken outcomes are needed to predict taken
+    //and it saturates at 3, so after many taken outcomes one not taken doesn't change prediction
+    run(t, "2bit", NewTwoBit(TableSize), forward, []step{
+        {true, false},
+        {true, true},
+        {true, true},
+        {true, true},
+        {false, true},
+        {true, true},
+        {false, true},
+        {false, true},
+        {false, false},
+        {false, false},
+        {true, false},
+        {true, false},
+        {true, true},
+    })
+}
+
+func TestOneBit(t *testing.T) {
+    //Prediction flips on every change of outcome
+    run(t, "1bit", NewOneBit(TableSize), forward, []step{
+        {true, false},
+        {false, true},
+        {false, false},
+        {true, false},
+        {true, true},
+    })
+}
+
+func TestCounterAliasing(t *testing.T) {
+    //Branches with the same low bits share the entry
+    p := NewTwoBit(TableSize)
+    other := Branch{Pc: forward.Pc + TableSize, Direct: true, Target: 3}
+    p.Update(other, true, 3)
+    p.Update(other, true, 3)
+    if taken, _ := p.Predict(forward); !taken {
+        t.Error("2bit doesn't share counter of branch with the same low bits")
+    }
+}
+
+func TestBTFN(t *testing.T) {
+    tests := []struct {
+        name  string
+        b     Branch
+        taken bool
+    }{
+        {"backward", Branch{Pc: 10, Direct: true, Target: 4}, true},
+        {"to itself", Branch{Pc: 10, Direct: true, Target: 10}, true},
+        {"forward", forward, false},
+        {"forward always taken", Branch{Pc: 10, Direct: true, Target: 20, Always: true}, true},
+        //Target of JR and RET isn't known on Fetch
+        {"indirect", Branch{Pc: 10, Always: true}, false},
+    }
+    for _, test := range tests {
+        taken, target := BTFN{}.Predict(test.b)
+        if taken != test.taken || taken && target != test.b.Target {
+            t.Errorf("%v: predicted %v to %d, want %v to %d", test.name, taken, target, test.taken, test.b.Target)
+        }
+    }
+}
+
+func TestNotTaken(t *testing.T) {
+    p := NotTaken{}
+    for range 3 {
+        p.Update(forward, true, forward.Target)
+    }
+    if taken, _ := p.Predict(forward); taken {
+        t.Error("not-taken predicts branch taken")
+    }
+}
+
+func TestBTB(t *testing.T) {
+    ret := Branch{Pc: 8, Always: true}
+    btb := NewBTB(BTBSize)
+    //Branch which isn't in buffer falls through, and not taken outcome doesn't put it there
+    btb.Update(ret, false, 0)
+    if taken, _ := btb.Predict(ret); taken {
+        t.Fatal("BTB predicts branch which isn't in it")
+    }
+    //Taken branch gets entry weakly taken with its target
+    btb.Update(ret, true, 3)
+    if taken, target := btb.Predict(ret); !taken || target != 3 {
+        t.Errorf("BTB predicts %v to %d, want taken to 3", taken, target)
+    }
+    //Target changes with the last taken outcome
+    btb.Update(ret, true, 5)
+    if _, target := btb.Predict(ret); target != 5 {
+        t.Errorf("BTB predicts target %d, want 5", target)
+    }
+    //Counter is 3, two not taken outcomes make it not taken
+    btb.Update(ret, false, 0)
+    if taken, _ := btb.Predict(ret); !taken {
+        t.Error("BTB entry isn't taken after one not taken outcome")
+    }
+    btb.Update(ret, false, 0)
+    if taken, _ := btb.Predict(ret); taken {
+        t.Error("BTB entry is taken after two not taken outcomes")
+    }
+    //Another branch with the same low bits takes the entry, it's a miss for the first one
+    btb.Update(ret, true, 3)
+    other := Branch{Pc: ret.Pc + BTBSize, Always: true}
+    btb.Update(other, true, 40)
+    if taken, _ := btb.Predict(ret); taken {
+        t.Error("BTB predicts evicted branch taken")
+    }
+    if taken, target := btb.Predict(other); !taken || target != 40 {
+        t.Errorf("BTB predicts new branch %v to %d, want taken to 40", taken, target)
+    }
+}
+
+func TestParse(t *testing.T) {
+    for _, name := range Names {
+        if p, err := Parse(name); err != nil || p == nil {
+            t.Errorf("Parse(%q) = %v, %v", name, p, err)
+        }
+    }
+    if _, err := Parse("3bit"); err == nil {
+        t.Error("unknown predictor 3bit is parsed")
+    }
+}
@@ -0,0 +1,133 @@
+// Performance counters of emulator
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Types of hazards which stall the pipe
+const (
+    HazardReg = "register"
+    HazardMem = "memory"
+    HazardFlags = "flags"
+    //Execute is busy with multi-cycle command
+    HazardStruct = "structural"
+)
+
+type Counters struct {
+    Cycles        uint64                       `json:"cycles"`
+    Retired       uint64                       `json:"retired"`
+    //Stall cycles by stage which waits for operand and type of hazard
+    Stalls        map[string]map[string]uint64 `json:"stalls"`
+    //Operands taken from later stages instead of registers or memory, by stage they come from
+    Forwards      map[string]uint64            `json:"forwards"`
+    //Jumps resolved on their resolution stage, taken ones and ones fetch went the wrong way after
+    Branches      uint64                       `json:"branches"`
+    TakenBranches uint64                       `json:"taken_branches"`
+    Mispredicts   uint64                       `json:"mispredicts"`
+    //Commands dropped from pipe by mispredicted branches, it's the flush penalty in cycles
+    FlushedSlots  uint64                       `json:"flushed_slots"`
+    //Retired commands by mnemonic
+    Mix           map[string]uint64            `json:"mix"`
+}
+
+func New() *Counters {
+    return &Counters{
+        Stalls: make(map[string]map[string]uint64),
+        Forwards: make(map[string]uint64),
+        Mix: make(map[string]uint64),
+    }
+}
+
+func (c *Counters) Stall(stage string, hazard string) {
+    if c.Stalls[stage] == nil {
+        c.Stalls[stage] = make(map[string]uint64)
+    }
+    c.Stalls[stage][hazard]++
+}
+
+func (c *Counters) Forward(from string) {
+    c.Forwards[from]++
+}
+
+func (c *Counters) Retire(mnemonic string) {
+    c.Retired++
+    c.Mix[mnemonic]++
+}
+
+//Branch is a hit if fetch went the right way after it
+func (c *Counters) Branch(taken bool, hit bool) {
+    c.Branches++
+    if taken {
+        c.TakenBranches++
+    }
+    if !hit {
+        c.Mispredicts++
+    }
+}
+
+func (c *Counters) Flush(slots int) {
+    c.FlushedSlots += uint64(slots)
+}
+
+func (c *Counters) StallCycles() uint64 {
+    var total uint64
+    for _, byHazard := range c.Stalls {
+        for _, n := range byHazard {
+            total += n
+        }
+    }
+    return total
+}
+
+// Cycles per retired command
+func (c *Counters) CPI() float64 {
+    if c.Retired == 0 {
+        return 0
+    }
+    return float64(c.Cycles) / float64(c.Retired)
+}
+
+// Share of branches predicted right, 1 if there were none
+func (c *Counters) Accuracy() float64 {
+    if c.Branches == 0 {
+        return 1
+    }
+    return float64(c.Branches-c.Mispredicts) / float64(c.Branches)
+}
+
+func (c *Counters) MarshalJSON() ([]byte, error) {
+    type counters Counters
+    return json.Marshal(struct {
+        *counters
+        CPI      float64 `json:"cpi"`
+        Accuracy float64 `json:"prediction_accuracy"`
+    }{(*counters)(c), c.CPI(), c.Accuracy()})
+}
+
+func (c *Counters) String() string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "Cycles: %d\nRetired: %d\nCPI: %.2f\n", c.Cycles, c.Retired, c.CPI())
+    fmt.Fprintf(&b, "Stall cycles: %d\n", c.StallCycles())
+    for _, stage := range slices.Sorted(maps.Keys(c.Stalls)) {
+        for _, hazard := range slices.Sorted(maps.Keys(c.Stalls[stage])) {
+            fmt.Fprintf(&b, "   %v, %v: %d\n", stage, hazard, c.Stalls[stage][hazard])
+        }
+    }
+    fmt.Fprintf(&b, "Forwards:\n")
+    for _, from := range slices.Sorted(maps.Keys(c.Forwards)) {
+        fmt.Fprintf(&b, "   from %v: %d\n", from, c.Forwards[from])
+    }
+    fmt.Fprintf(&b, "Branches: %d\nTaken branches: %d\n", c.Branches, c.TakenBranches)
+    fmt.Fprintf(&b, "Mispredicts: %d\nPrediction accuracy: %.2f%%\n", c.Mispredicts, 100*c.Accuracy())
+    fmt.Fprintf(&b, "Flushed slots: %d\n", c.FlushedSlots)
+    fmt.Fprintf(&b, "Instruction mix:\n")
+    for _, mnemonic := range slices.Sorted(maps.Keys(c.Mix)) {
+        fmt.Fprintf(&b, "   %v: %d\n", mnemonic, c.Mix[mnemonic])
+    }
+    return b.String()
+}
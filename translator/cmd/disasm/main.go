@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+    "github.com/Tyulenb/Pennywise700/disasm"
+    "github.com/Tyulenb/Pennywise700/isa"
+)
+
+func main() {
+    args := os.Args
+    if len(args) != 2 {
+        fmt.Println("FORMAT main.go 'path to your program'")
+        return
+    }
+    file, err := os.Open(args[1])
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    defer file.Close()
+
+    coms, config, err := isa.ReadProgramConfig(file)
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    set, err := isa.New(config)
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    lines, err := disasm.ProgramFor(set, coms)
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    for _, line := range lines {
+        fmt.Println(line)
+    }
+}
@@ -1,21 +1,48 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"os"
+    "github.com/Tyulenb/Pennywise700/isa"
     "github.com/Tyulenb/Pennywise700/translator/internal"
 )
 
 func main() {
-    args := os.Args
-    if len(args) != 3 {
-        fmt.Println("FORMAT main.go 'path to your assembly language' 'output file'")
+    nops := flag.Bool("nops", false, "insert NOPs for pipeline without interlocks, jumps resolved on write back")
+    mem := flag.Int("mem", isa.DefaultConfig.Mem, "cells of data memory of machine")
+    cmd := flag.Int("cmd", isa.DefaultConfig.Cmd, "cells of command memory of machine")
+    regs := flag.Int("regs", isa.DefaultConfig.Regs, "registers of machine")
+    flag.Usage = func() {
+        fmt.Println("FORMAT main.go [-nops] [-mem N] [-cmd N] [-regs N] 'path to your assembly language' 'output file'")
+    }
+    flag.Parse()
+    args := flag.Args()
+    if len(args) != 2 {
+        flag.Usage()
+        return
+    }
+    in := args[0]
+    out := args[1]
+    config := isa.Config{Mem: *mem, Cmd: *cmd, Regs: *regs}
+    set, err := isa.New(config)
+    if err != nil {
+        fmt.Println(err)
         return
     }
-    in := args[1]
-    out := args[2]
-    coms, err := internal.Assemble(in)
+    var coms []uint32
+    if *nops {
+        var inserted []internal.Nop
+        coms, inserted, err = internal.AssembleNops(in, set)
+        for _, nop := range inserted {
+            fmt.Printf("NOP at %d covers:\n", nop.Adr)
+            for _, h := range nop.Hazards {
+                fmt.Println("   ", h)
+            }
+        }
+    } else {
+        coms, err = internal.Assemble(in, set)
+    }
     if err != nil {
         fmt.Println(err)
         return
@@ -28,27 +55,8 @@ func main() {
     }
     defer file.Close()
 
-    writer := bufio.NewWriter(file)
-
-    for i := range coms {
-        bin := toBin(coms[i])
-        _, err := writer.WriteString(bin+"\n")
-        if err != nil {
-            fmt.Println(err)
-            return
-        }
-    }
-    writer.Flush()
-}
-
-func toBin(num uint32) string {
-    var result string
-    for i := 31; i >= 8; i-- {
-        if num&(1<<i) != 0 {
-            result += "1"
-        }else {
-            result += "0"
-        }
+    if err := isa.WriteProgramConfig(file, coms, config); err != nil {
+        fmt.Println(err)
+        return
     }
-    return result
 }
@@ -1,3 +1,7 @@
 module github.com/Tyulenb/Pennywise700/translator
 
 go 1.25.3
+
+require github.com/Tyulenb/Pennywise700 v0.0.0
+
+replace github.com/Tyulenb/Pennywise700 => ../emu
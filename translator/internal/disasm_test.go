@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Tyulenb/Pennywise700/disasm"
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+// Disassembled program is assembled again
+func roundTrip(t *testing.T, code []uint32) ([]disasm.Line, []uint32) {
+	t.Helper()
+	lines, err := disasm.Program(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var source strings.Builder
+	for _, line := range lines {
+		fmt.Fprintln(&source, line)
+	}
+	again, err := assembleSource(t, source.String())
+	if err != nil {
+		t.Fatalf("%v\n%v", err, source.String())
+	}
+	return lines, again
+}
+
+func TestDisassemblerRoundTrip(t *testing.T) {
+	code, err := Assemble("../../docs/insertion_sort.txt", isa.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, again := roundTrip(t, code)
+	if !slices.Equal(again, code) {
+		t.Errorf("program after round trip:\n%v\nwant:\n%v", disassemble(again), disassemble(code))
+	}
+
+	//Targets of jumps get labels and jumps refer to them
+	labels := map[int]string{6: "L6", 9: "L9", 18: "L18", 21: "L21"}
+	for adr, line := range lines {
+		if line.Label != labels[adr] {
+			t.Errorf("label of %d is %q, want %q", adr, line.Label, labels[adr])
+		}
+	}
+	texts := map[int]string{6: "JGEU 2, 3, L21", 9: "JGEU 0, 5, L18", 17: "JMP L9", 20: "JMP L6"}
+	for adr, text := range texts {
+		if lines[adr].Text != text {
+			t.Errorf("command at %d is %q, want %q", adr, lines[adr].Text, text)
+		}
+	}
+	//Commands which don't jump are given the same way as by debugger and diagram
+	for adr, line := range lines {
+		if isa.Decode(code[adr]).WritesTo(isa.PC) {
+			continue
+		}
+		if want := isa.Disassemble(code[adr]); line.Text != want {
+			t.Errorf("command at %d is %q, instruction set gives %q", adr, line.Text, want)
+		}
+	}
+}
+
+// Words which are not commands are given as raw data
+func TestDisassemblerData(t *testing.T) {
+	illegal := uint32(isa.Ext)<<20 | 0xFF
+	//NOP has no operands, so set bits can't be given by it
+	extra := uint32(isa.NOP | 1)
+	code := []uint32{encode("JMP", 2), illegal, extra, encode("HALT")}
+	lines, again := roundTrip(t, code)
+	if !slices.Equal(again, code) {
+		t.Errorf("program after round trip:\n%v\nwant:\n%v", disassemble(again), disassemble(code))
+	}
+	for adr, cmd := range map[int]uint32{1: illegal, 2: extra} {
+		if want := fmt.Sprintf("WORD %d", cmd); lines[adr].Text != want {
+			t.Errorf("word at %d is %q, want %q", adr, lines[adr].Text, want)
+		}
+	}
+	if lines[2].Label != "L2" {
+		t.Errorf("data jumped to has label %q, want L2", lines[2].Label)
+	}
+}
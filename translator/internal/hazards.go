@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+// Data hazard, consumer reads operand before producer writes it
+type Hazard struct {
+	Operand      string
+	Stage        int
+	Producer     uint32
+	ProducerLine int
+	Consumer     uint32
+	ConsumerLine int
+	//Instruction set commands are decoded by
+	set *isa.ISA
+}
+
+func (h Hazard) String() string {
+	return fmt.Sprintf("%v written by '%v' (line %d) is read on %v by '%v' (line %d)",
+		h.Operand, h.set.Disassemble(h.Producer), h.ProducerLine, isa.StageNames[h.Stage], h.set.Disassemble(h.Consumer), h.ConsumerLine)
+}
+
+// NOP inserted by InsertNops
+type Nop struct {
+	Adr     int
+	Hazards []Hazard
+}
+
+// Place read or written by command, mem without address stands for any cell
+func place(set *isa.ISA, cmd uint32, a isa.Access) (string, bool) {
+	switch a.Loc {
+	case isa.Reg:
+		return fmt.Sprintf("r%d", a.Field.Decode(cmd)), true
+	case isa.Mem:
+		return fmt.Sprintf("mem[%d]", a.Field.Decode(cmd)), true
+	case isa.StackPtr:
+		return fmt.Sprintf("r%d", set.SP), true
+	case isa.MemInd, isa.StackTop, isa.StackNext:
+		return "mem", true
+	case isa.Flags:
+		return "flags", true
+	}
+	return "", false
+}
+
+// Operands of producer read by consumer before they are written
+// Distance is amount of commands from producer to consumer
+// Returns hazards and amount of NOPs each of them needs, words which are not commands have none
+func hazards(set *isa.ISA, producer, consumer uint32, distance int) ([]Hazard, []int) {
+	found := make([]Hazard, 0)
+	need := make([]int, 0)
+	if set.Decode(producer) == nil || set.Decode(consumer) == nil {
+		return found, need
+	}
+	for _, w := range set.Decode(producer).Writes {
+		wPlace, ok := place(set, producer, w)
+		if !ok {
+			continue
+		}
+		for _, r := range set.Decode(consumer).Reads {
+			rPlace, ok := place(set, consumer, r)
+			//Operands read on write back are always ready
+			if !ok || r.Stage == isa.WriteBack || r.Stage+distance >= w.Stage {
+				continue
+			}
+			if wPlace == rPlace || wPlace == "mem" && strings.HasPrefix(rPlace, "mem") {
+				found = append(found, Hazard{Operand: rPlace, Stage: r.Stage, Producer: producer, Consumer: consumer, set: set})
+				need = append(need, w.Stage-r.Stage-distance)
+			}
+		}
+	}
+	return found, need
+}
+
+// Commands after these are never executed right after them. Jumps are taken to be
+// resolved on write back, so the pipe is drained when commands after them are reached by jump.
+// With early resolution commands before a JMP are still in the pipe, that isn't handled
+func fallsThrough(set *isa.ISA, cmd uint32) bool {
+	in := set.Decode(cmd)
+	if in == nil {
+		return true
+	}
+	switch in.ID {
+	case isa.JMP, isa.JR, isa.CALL, isa.RET, isa.HALT:
+		return false
+	}
+	return true
+}
+
+// Inserts minimal amount of NOPs, so that program is correct on pipeline without interlocks
+// Result of command is forwarded from write back, so consumer has to read it
+// not earlier than producer gets to write back. Jump addresses are moved to new places
+// of commands, jumps skip NOPs inserted for the fall through path
+func InsertNops(set *isa.ISA, code []uint32, lines []int) ([]uint32, []Nop, error) {
+	result := make([]uint32, 0, len(code))
+	resultLines := make([]int, 0, len(code))
+	newAdr := make([]int, len(code))
+	nops := make([]Nop, 0)
+
+	for i, cmd := range code {
+		//Hazards with older commands, which are still in the pipe, and NOPs each needs
+		found := make([]Hazard, 0)
+		need := make([]int, 0)
+		for back := 1; back < isa.WriteBack && i-back >= 0 && fallsThrough(set, code[i-back]); back++ {
+			j := i - back
+			distance := len(result) - newAdr[j]
+			hs, ns := hazards(set, code[j], cmd, distance)
+			for n := range hs {
+				hs[n].ProducerLine, hs[n].ConsumerLine = lines[j], lines[i]
+			}
+			found = append(found, hs...)
+			need = append(need, ns...)
+		}
+		for k := 1; ; k++ {
+			covered := make([]Hazard, 0)
+			for n, h := range found {
+				if need[n] >= k {
+					covered = append(covered, h)
+				}
+			}
+			if len(covered) == 0 {
+				break
+			}
+			nops = append(nops, Nop{len(result), covered})
+			result = append(result, isa.NOP)
+			resultLines = append(resultLines, lines[i])
+		}
+		newAdr[i] = len(result)
+		result = append(result, cmd)
+		resultLines = append(resultLines, lines[i])
+	}
+
+	//Jump addresses are moved with commands
+	size := set.Cmd
+	if len(result) > size {
+		return nil, nil, fmt.Errorf("Error: Program with NOPs takes %d commands, but only %d fit", len(result), size)
+	}
+	for i, cmd := range result {
+		in := set.Decode(cmd)
+		if in == nil {
+			continue
+		}
+		for _, f := range in.Operands {
+			if f.Kind != isa.KindCmd {
+				continue
+			}
+			adr := int(f.Decode(cmd))
+			if adr < len(code) {
+				adr = newAdr[adr]
+			} else {
+				adr += len(result) - len(code)
+			}
+			if adr >= size {
+				return nil, nil, fmt.Errorf("Error: Jump address %d doesn't fit after NOPs in line %d", adr, resultLines[i])
+			}
+			cmd = cmd&^f.Mask() | f.Encode(uint16(adr))
+		}
+		result[i] = cmd
+	}
+	return result, nops, nil
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+func encode(mnemonic string, ops ...uint16) uint32 {
+	return isa.ByMnemonic(mnemonic).Encode(ops)
+}
+
+// Lines of source are numbered from 1, one command per line
+func lineNumbers(code []uint32) []int {
+	lines := make([]int, len(code))
+	for i := range lines {
+		lines[i] = i + 1
+	}
+	return lines
+}
+
+// Independent command put between producer and consumer
+var filler = encode("LTR", 9, 0)
+
+// Producer, fillers to make distance, and consumer
+func distant(producer uint32, distance int, consumer uint32) []uint32 {
+	code := []uint32{producer}
+	for range distance - 1 {
+		code = append(code, filler)
+	}
+	return append(code, consumer)
+}
+
+func TestInsertNops(t *testing.T) {
+	tests := []struct {
+		name string
+		code []uint32
+		//Addresses NOPs are put to in result
+		nops []int
+	}{
+		//r3 is written on write back and read on Decode 1, it's forwarded from write back
+		{"register on Decode 1, distance 1", distant(encode("LTR", 3, 5), 1, encode("SUB", 3, 1, 4)), []int{1, 2}},
+		{"register on Decode 1, distance 2", distant(encode("LTR", 3, 5), 2, encode("SUB", 3, 1, 4)), []int{2}},
+		{"register on Decode 1, distance 3", distant(encode("LTR", 3, 5), 3, encode("SUB", 3, 1, 4)), nil},
+		{"register on Decode 2, distance 1", distant(encode("LTR", 3, 5), 1, encode("SUB", 1, 3, 4)), []int{1}},
+		{"register on Decode 2, distance 2", distant(encode("LTR", 3, 5), 2, encode("SUB", 1, 3, 4)), nil},
+		{"independent commands", []uint32{encode("LTR", 3, 5), encode("SUB", 1, 2, 4)}, nil},
+		//Register read on write back is always ready
+		{"register on write back", []uint32{encode("LTR", 3, 5), encode("RTMK", 1, 3)}, nil},
+		{"same memory cell", []uint32{encode("LTM", 7, 5), encode("MTR", 3, 5)}, []int{1}},
+		{"other memory cell", []uint32{encode("LTM", 7, 5), encode("MTR", 3, 6)}, nil},
+		//Indirect write can go to any cell
+		{"indirect write", []uint32{encode("RTMK", 1, 2), encode("MTR", 3, 5)}, []int{1}},
+		{"indirect read on write back", []uint32{encode("LTM", 7, 5), encode("MTRK", 3, 1)}, nil},
+		//Two hazards of one consumer share NOPs
+		{"two operands", []uint32{encode("LTR", 3, 5), encode("LTR", 4, 5), encode("SUB", 3, 4, 6)}, []int{2}},
+	}
+	for _, test := range tests {
+		result, nops, err := InsertNops(isa.Default, test.code, lineNumbers(test.code))
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		got := make([]int, 0)
+		for _, nop := range nops {
+			got = append(got, nop.Adr)
+			if result[nop.Adr] != isa.NOP {
+				t.Errorf("%v: command %v at %d, want NOP", test.name, isa.Disassemble(result[nop.Adr]), nop.Adr)
+			}
+		}
+		if !slices.Equal(got, test.nops) {
+			t.Errorf("%v: NOPs at %v, want %v", test.name, got, test.nops)
+		}
+		if len(result) != len(test.code)+len(test.nops) {
+			t.Errorf("%v: %d commands, want %d", test.name, len(result), len(test.code)+len(test.nops))
+		}
+	}
+}
+
+// Commands after these are reached only by jump, pipe is drained then
+func TestInsertNopsAfterJumps(t *testing.T) {
+	for _, jump := range []uint32{
+		encode("JMP", 5),
+		encode("JR", 0),
+		encode("CALL", 5),
+		encode("RET"),
+		encode("HALT"),
+	} {
+		code := []uint32{encode("LTR", 3, 5), jump, encode("SUB", 3, 3, 4)}
+		result, nops, err := InsertNops(isa.Default, code, lineNumbers(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nops) != 0 || !slices.Equal(result, code) {
+			t.Errorf("after %v: %d NOPs inserted", isa.Disassemble(jump), len(nops))
+		}
+	}
+}
+
+func TestInsertNopsMovesJumps(t *testing.T) {
+	code := []uint32{
+		encode("LTR", 3, 5),
+		encode("SUB", 3, 1, 4),
+		encode("JMP", 1),
+		//Address past the end of program moves by amount of NOPs
+		encode("JNE", 3, 0, 4),
+	}
+	want := []uint32{
+		encode("LTR", 3, 5),
+		isa.NOP,
+		isa.NOP,
+		encode("SUB", 3, 1, 4),
+		encode("JMP", 3),
+		encode("JNE", 3, 0, 6),
+	}
+	result, _, err := InsertNops(isa.Default, code, lineNumbers(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result, want) {
+		t.Errorf("result:\n%v\nwant:\n%v", disassemble(result), disassemble(want))
+	}
+
+	//Moved address must still fit in command memory
+	small, err := isa.New(isa.Config{Mem: 16, Cmd: 5, Regs: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = []uint32{
+		small.ByMnemonic("LTR").Encode([]uint16{3, 5}),
+		small.ByMnemonic("SUB").Encode([]uint16{3, 1, 4}),
+		small.ByMnemonic("JMP").Encode([]uint16{4}),
+	}
+	if _, _, err := InsertNops(small, code, lineNumbers(code)); err == nil {
+		t.Error("program of 5 commands with jump to 6 is accepted for command memory of 5")
+	}
+}
+
+func disassemble(code []uint32) []string {
+	text := make([]string, len(code))
+	for i, cmd := range code {
+		text[i] = isa.Disassemble(cmd)
+	}
+	return text
+}
+
+func TestHazardReport(t *testing.T) {
+	code := []uint32{encode("LTR", 3, 5), encode("SUB", 1, 3, 4), encode("LTM", 7, 5), encode("MTR", 6, 5)}
+	_, nops, err := InsertNops(isa.Default, code, []int{10, 11, 13, 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"r3 written by 'LTR 3, 5' (line 10) is read on Decode 2 by 'SUB 1, 3, 4' (line 11)"},
+		{"mem[5] written by 'LTM 7, 5' (line 13) is read on Decode 2 by 'MTR 6, 5' (line 14)"},
+	}
+	if len(nops) != len(want) {
+		t.Fatalf("%d NOPs, want %d", len(nops), len(want))
+	}
+	for i, nop := range nops {
+		got := make([]string, len(nop.Hazards))
+		for j, h := range nop.Hazards {
+			got[j] = h.String()
+		}
+		if !slices.Equal(got, want[i]) {
+			t.Errorf("NOP %d covers %q, want %q", i, got, want[i])
+		}
+	}
+}
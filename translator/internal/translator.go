@@ -7,219 +7,179 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
-)
 
-var commands = map[string]func([]string) (uint32, error){
-	"NOP":       asbNOP,       //0x0
-	"LTM":       asbLTM,       //0x1
-	"MTR":       asbMTR,       //0x2
-	"RTR":       asbRTR,       //0x3
-	"SUB":       asbSUB,       //0x4
-	"JUMP_LESS": asbJUMP_LESS, //0x5
-	"MTRK":      asbMTRK,      //0x6
-	"RTMK":      asbRTMK,      //0x7
-	"JMP":       asbJMP,       //0x8
-	"SUM":       asbSUM,       //0x9
-}
+	"github.com/Tyulenb/Pennywise700/isa"
+)
 
+// Minus is kept in tokens for signed literals
 func sep(c rune) bool {
-	return !unicode.IsNumber(c) && !unicode.IsLetter(c) && c != '_'
+	return !unicode.IsNumber(c) && !unicode.IsLetter(c) && c != '_' && c != '-'
 }
 
-//Takes path to program
-//Returns array of numeric values of commands
-func Assemble(path string) ([]uint32, error) {
-	assembler, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// Label is a name of command address, it can't start with digit
+func isLabel(s string) bool {
+	if s == "" || unicode.IsNumber(rune(s[0])) {
+		return false
 	}
-	machineCode := make([]uint32, 0)
-
-	scanner := bufio.NewScanner(assembler)
-	lineNumber := 1
-	for scanner.Scan() {
-		str := scanner.Text()
-		cmdsLine := strings.Split(str, ";")
-        cmd := cmdsLine[0]
-
-        tokens := strings.FieldsFunc(cmd, sep)
-        code, err := commands[tokens[0]](tokens)
-        if err != nil {
-            return nil, fmt.Errorf("Error: %v in line %d", err, lineNumber)
-        }
-        machineCode = append(machineCode, code)
-
-		lineNumber++
-	}
-
-	return machineCode, nil
+	return !strings.ContainsFunc(s, sep) && !strings.ContainsRune(s, '-')
 }
 
-func asbNOP(tokens []string) (uint32, error) {
-	if len(tokens) == 1 {
-		return 0, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for NOP command, expected 1, but got %v", len(tokens))
+// Cuts 'label:' definitions from the beginning of command
+func cutLabels(cmd string) ([]string, string) {
+	labels := make([]string, 0)
+	for {
+		name, rest, found := strings.Cut(cmd, ":")
+		name = strings.TrimSpace(name)
+		if !found || !isLabel(name) {
+			return labels, cmd
+		}
+		labels = append(labels, name)
+		cmd = rest
 	}
 }
 
-func asbLTM(tokens []string) (uint32, error) {
-	if len(tokens) == 3 {
-		adr_m, err := strconv.ParseUint(tokens[2], 10, 10)
-		if err != nil {
-			return 0, err
+// Replaces labels in command address operands with their addresses
+func resolveLabels(in *isa.Instr, tokens []string, labels map[string]int) error {
+	for i, f := range in.Operands {
+		if f.Kind != isa.KindCmd || i+1 >= len(tokens) || !isLabel(tokens[i+1]) {
+			continue
 		}
-		literal, err := strconv.ParseUint(tokens[1], 10, 10)
-		if err != nil {
-			return 0, err
+		adr, ok := labels[tokens[i+1]]
+		if !ok {
+			return fmt.Errorf("Undefined label %v", tokens[i+1])
 		}
-		code := uint32((0x1 << 28) | (literal << 18) | (adr_m << 8))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for LTM command, expected 3, but got %v", len(tokens))
+		tokens[i+1] = strconv.Itoa(adr)
 	}
+	return nil
 }
 
-func asbMTR(tokens []string) (uint32, error) {
-	if len(tokens) == 3 {
-		adr_r, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_m, err := strconv.ParseUint(tokens[2], 10, 10)
-		if err != nil {
-			return 0, err
-		}
-		code := uint32((0x2 << 28) | (adr_r << 24) | (adr_m << 8))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for MTR command, expected 3, but got %v", len(tokens))
-	}
+// Command of program with number of its line in source
+type sourceLine struct {
+	number int
+	tokens []string
 }
 
-func asbRTR(tokens []string) (uint32, error) {
-	if len(tokens) == 3 {
-		adr_m, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_r, err := strconv.ParseUint(tokens[2], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		code := uint32((0x3 << 28) | (adr_m << 24) | (adr_r << 20))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for RTR command, expected 3, but got %v", len(tokens))
-	}
+//Takes path to program and instruction set of machine it's for
+//Returns array of numeric values of commands
+func Assemble(path string, set *isa.ISA) ([]uint32, error) {
+	machineCode, _, err := assemble(path, set)
+	return machineCode, err
 }
 
-func asbSUB(tokens []string) (uint32, error) {
-	if len(tokens) == 4 {
-		adr_r1, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_r2, err := strconv.ParseUint(tokens[2], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_r3, err := strconv.ParseUint(tokens[3], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		code := uint32((0x4 << 28) | (adr_r1 << 24) | (adr_r2 << 20) | (adr_r3 << 16))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for SUB command, expected 4, but got %v", len(tokens))
+//Same as Assemble, but NOPs are inserted for pipeline without interlocks
+//Returns inserted NOPs with hazards they cover
+func AssembleNops(path string, set *isa.ISA) ([]uint32, []Nop, error) {
+	machineCode, lines, err := assemble(path, set)
+	if err != nil {
+		return nil, nil, err
 	}
+	return InsertNops(set, machineCode, lines)
 }
 
-func asbJUMP_LESS(tokens []string) (uint32, error) {
-	if len(tokens) == 4 {
-		adr_r1, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_r2, err := strconv.ParseUint(tokens[2], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_to_jmp, err := strconv.ParseUint(tokens[3], 10, 10)
-		if err != nil {
-			return 0, err
-		}
-		code := uint32((0x5 << 28) | (adr_r1 << 24) | (adr_r2 << 20) | (adr_to_jmp << 8))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for JUMP_LESS command, expected 4, but got %v", len(tokens))
+//Returns commands and numbers of their lines in source
+func assemble(path string, set *isa.ISA) ([]uint32, []int, error) {
+	assembler, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
 	}
-}
+	defer assembler.Close()
 
-func asbMTRK(tokens []string) (uint32, error) {
-	if len(tokens) == 3 {
-		adr_r1, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
+	//First pass, collect commands and addresses of labels
+	program := make([]sourceLine, 0)
+	labels := make(map[string]int)
+	labelLines := make(map[string]int)
+
+	scanner := bufio.NewScanner(assembler)
+	lineNumber := 1
+	for scanner.Scan() {
+		str := scanner.Text()
+		cmdsLine := strings.Split(str, ";")
+		names, cmd := cutLabels(cmdsLine[0])
+		for _, name := range names {
+			if first, ok := labelLines[name]; ok {
+				return nil, nil, fmt.Errorf("Error: Duplicate label %v in line %d, first defined in line %d", name, lineNumber, first)
+			}
+			labels[name] = len(program)
+			labelLines[name] = lineNumber
 		}
-		adr_r2, err := strconv.ParseUint(tokens[2], 10, 4)
-		if err != nil {
-			return 0, err
+
+		tokens := strings.FieldsFunc(cmd, sep)
+		if len(tokens) > 0 {
+			program = append(program, sourceLine{lineNumber, tokens})
 		}
-		code := uint32((0x6 << 28) | (adr_r1 << 24) | (adr_r2 << 20))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for MTRK command, expected 3, but got %v", len(tokens))
+		lineNumber++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
 	}
-}
 
-func asbRTMK(tokens []string) (uint32, error) {
-	if len(tokens) == 3 {
-		adr_r1, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		adr_r2, err := strconv.ParseUint(tokens[2], 10, 4)
-		if err != nil {
-			return 0, err
-		}
-		code := uint32((0x7 << 28) | (adr_r1 << 24) | (adr_r2 << 20))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for RTMK command, expected 3, but got %v", len(tokens))
+	if len(program) > set.Cmd {
+		return nil, nil, fmt.Errorf("Error: Program of %d commands doesn't fit in command memory of %d commands", len(program), set.Cmd)
+	}
+
+	//Second pass, assemble commands with resolved labels
+	machineCode := make([]uint32, 0, len(program))
+	lines := make([]int, 0, len(program))
+	for _, line := range program {
+		var code uint32
+		if line.tokens[0] == isa.Word {
+			code, err = asbWord(set, line.tokens)
+		} else {
+			in := set.ByMnemonic(line.tokens[0])
+			if in == nil {
+				return nil, nil, fmt.Errorf("Error: Unknown command %v in line %d", line.tokens[0], line.number)
+			}
+			if err := resolveLabels(in, line.tokens, labels); err != nil {
+				return nil, nil, fmt.Errorf("Error: %v in line %d", err, line.number)
+			}
+			code, err = asb(set, in, line.tokens)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error: %v in line %d", err, line.number)
+		}
+		machineCode = append(machineCode, code)
+		lines = append(lines, line.number)
 	}
+
+	return machineCode, lines, nil
 }
 
-func asbJMP(tokens []string) (uint32, error) {
-	if len(tokens) == 2 {
-		adr_to_jmp, err := strconv.ParseUint(tokens[1], 10, 10)
-		if err != nil {
-			return 0, err
-		}
-		code := uint32((0x8 << 28) | (adr_to_jmp << 8))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for JMP command, expected 2, but got %v", len(tokens))
+// Raw word of command memory, it can be any value of command width
+func asbWord(set *isa.ISA, tokens []string) (uint32, error) {
+	if len(tokens) != 2 {
+		return 0, fmt.Errorf("Expected one operand of %v, but got %v", isa.Word, len(tokens)-1)
+	}
+	val, err := strconv.ParseUint(tokens[1], 10, int(set.Width))
+	if err != nil {
+		return 0, err
 	}
+	return uint32(val), nil
 }
 
-func asbSUM(tokens []string) (uint32, error) {
-	if len(tokens) == 4 {
-		adr_r1, err := strconv.ParseUint(tokens[1], 10, 4)
-		if err != nil {
-			return 0, err
+// Encodes command, operands are checked to fit their fields,
+// and addresses to fit in registers and memories of machine
+func asb(set *isa.ISA, in *isa.Instr, tokens []string) (uint32, error) {
+	if len(tokens) != len(in.Operands)+1 {
+		return 0, fmt.Errorf("Unexpected amount of operands for %v command, expected %v, but got %v", in.Mnemonic, len(in.Operands)+1, len(tokens))
+	}
+	vals := make([]uint16, len(in.Operands))
+	for i, f := range in.Operands {
+		if f.Kind == isa.KindInt {
+			val, err := strconv.ParseInt(tokens[i+1], 10, int(f.Width))
+			if err != nil {
+				return 0, err
+			}
+			vals[i] = uint16(val)
+			continue
 		}
-		adr_r2, err := strconv.ParseUint(tokens[2], 10, 4)
+		val, err := strconv.ParseUint(tokens[i+1], 10, int(f.Width))
 		if err != nil {
 			return 0, err
 		}
-		adr_r3, err := strconv.ParseUint(tokens[3], 10, 4)
-		if err != nil {
-			return 0, err
+		if int(val) >= set.Limit(f) {
+			return 0, fmt.Errorf("Operand %v of %v command is %v, but it must be less than %d", f.Name, in.Mnemonic, val, set.Limit(f))
 		}
-		code := uint32((0x9 << 28) | (adr_r1 << 24) | (adr_r2 << 20) | (adr_r3 << 16))
-		return code, nil
-	} else {
-		return 0, fmt.Errorf("Unexpected amount of operands for SUM command, expected 4, but got %v", len(tokens))
+		vals[i] = uint16(val)
 	}
+	return in.Encode(vals), nil
 }
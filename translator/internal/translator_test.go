@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Tyulenb/Pennywise700/isa"
+)
+
+// Writes source to a file and assembles it for default machine
+func assembleSource(t *testing.T, source string) ([]uint32, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "program.txt")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Assemble(path, isa.Default)
+}
+
+// docs/insertion_sort.txt with addresses instead of labels
+const numericSort = `LTM 5, 0;
+LTM 7, 1;
+LTM 4, 2;
+LTM 3, 3;
+RTR 2, 1;
+MTR 3, 3;
+JUMP_LESS 2, 3, 21;
+MTRK 4, 2;
+RTR 5, 2;
+JUMP_LESS 0, 5, 18;
+SUB 5, 1, 6;
+MTRK 7, 6;
+JUMP_LESS 4, 7, 18;
+MTRK 8, 5;
+RTMK 6, 8;
+RTMK 5, 7;
+RTR 5, 6;
+JMP 9;
+RTMK 5, 4;
+SUM 2, 1, 2;
+JMP 6;
+NOP;
+`
+
+func TestLabels(t *testing.T) {
+	labelled, err := Assemble("../../docs/insertion_sort.txt", isa.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numeric, err := assembleSource(t, numericSort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(labelled, numeric) {
+		t.Errorf("labelled program:\n%v\nnumeric program:\n%v", disassemble(labelled), disassemble(numeric))
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		//Parts of error message
+		want []string
+	}{
+		{"duplicate", "loop: NOP;\nNOP;\nloop: JMP loop;\n", []string{"Duplicate label loop", "line 3", "line 1"}},
+		{"undefined", "NOP;\nJMP nowhere;\n", []string{"Undefined label nowhere", "line 2"}},
+		{"undefined in conditional jump", "JEQ 1, 2, nowhere;\n", []string{"Undefined label nowhere", "line 1"}},
+	}
+	for _, test := range tests {
+		_, err := assembleSource(t, test.source)
+		if err == nil {
+			t.Errorf("%v: no error", test.name)
+			continue
+		}
+		for _, part := range test.want {
+			if !strings.Contains(err.Error(), part) {
+				t.Errorf("%v: error %q doesn't contain %q", test.name, err, part)
+			}
+		}
+	}
+}
+
+// Label on a line without command is address of the next command
+func TestLabelWithoutCommand(t *testing.T) {
+	code, err := assembleSource(t, "NOP;\nloop:\n; comment\nfirst: second:\nLTR 2, 1;\nJMP loop;\nJMP first;\nJMP second;\nJMP end;\nend:\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{
+		isa.NOP,
+		encode("LTR", 2, 1),
+		encode("JMP", 1),
+		encode("JMP", 1),
+		encode("JMP", 1),
+		//Label after the last command is the address after it
+		encode("JMP", 6),
+	}
+	if !slices.Equal(code, want) {
+		t.Errorf("program:\n%v\nwant:\n%v", disassemble(code), disassemble(want))
+	}
+}